@@ -0,0 +1,154 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cLatencySamples is the number of commit latencies kept to compute percentiles from.
+const cLatencySamples = 100000
+
+var (
+	commitLatency latencyRecorder
+	warmup        warmupState
+)
+
+// warmupState holds the stats as of the end of -warmup, the benchmark only reports what
+// happened after it.
+type warmupState struct {
+	sync.Mutex
+	running bool
+	done    bool
+	stats   progStats
+}
+
+// start begins the warmup, it lasts for d.
+func (w *warmupState) start(d time.Duration) {
+	w.Lock()
+	w.running = true
+	w.Unlock()
+
+	time.AfterFunc(d, func() {
+		s := snapshotStats()
+		commitLatency.reset()
+
+		w.Lock()
+		defer w.Unlock()
+		w.running = false
+		w.done = true
+		w.stats = s
+		infof("Warmup of %v is over, measuring the benchmark\n", d)
+	})
+}
+
+// mark is added to the periodic stats during the warmup.
+func (w *warmupState) mark() string {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.running {
+		return " (warmup)"
+	}
+	return ""
+}
+
+// latencyRecorder keeps the count and sum of commit latencies, along with a uniform
+// sample of them to compute percentiles from.
+type latencyRecorder struct {
+	sync.Mutex
+	count   int64
+	sum     time.Duration
+	samples []time.Duration
+}
+
+func (l *latencyRecorder) record(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.count++
+	l.sum += d
+	if len(l.samples) < cLatencySamples {
+		l.samples = append(l.samples, d)
+	} else if i := rand.Int63n(l.count); i < cLatencySamples {
+		// reservoir sampling keeps every latency with the same probability
+		l.samples[i] = d
+	}
+}
+
+func (l *latencyRecorder) reset() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.count = 0
+	l.sum = 0
+	l.samples = l.samples[:0]
+}
+
+func (l *latencyRecorder) summary() (avg, p99 time.Duration) {
+	_, avg, p99 = l.stats()
+	return avg, p99
+}
+
+// stats returns the number of latencies recorded along with their average and p99.
+func (l *latencyRecorder) stats() (count int64, avg, p99 time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.count == 0 {
+		return 0, 0, 0
+	}
+
+	sorted := append([]time.Duration(nil), l.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return l.count, l.sum / time.Duration(l.count), sorted[len(sorted)*99/100]
+}
+
+// reportBenchmark prints the summary of a benchmark run, followed by a single
+// machine readable line for scripts.
+func reportBenchmark(elapsed time.Duration) {
+	s := snapshotStats()
+	if opts.Warmup > 0 {
+		warmup.Lock()
+		if warmup.done {
+			s = s.since(warmup.stats)
+			elapsed -= opts.Warmup
+		} else {
+			warnf("Benchmark ended during the warmup, reporting all of it\n")
+		}
+		warmup.Unlock()
+	}
+	avg, p99 := commitLatency.summary()
+	rate := float64(s.Commits) / elapsed.Seconds()
+
+	fmt.Printf("Benchmark ran for %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("  tweets read:     %d\n", s.Tweets)
+	fmt.Printf("  committed:       %d\n", s.Commits)
+	fmt.Printf("  aborted:         %d\n", s.Retries)
+	fmt.Printf("  failed:          %d\n", s.Failures+s.ErrorsDgraph+s.Overloaded)
+	fmt.Printf("  avg latency:     %v\n", avg.Round(time.Microsecond))
+	fmt.Printf("  p99 latency:     %v\n", p99.Round(time.Microsecond))
+	fmt.Printf("  commits/sec:     %.2f\n", rate)
+	fmt.Printf("BENCHMARK run_id=%s duration_sec=%.3f tweets=%d commits=%d aborts=%d failures=%d "+
+		"avg_latency_ms=%.3f p99_latency_ms=%.3f commits_per_sec=%.2f\n",
+		opts.RunID, elapsed.Seconds(), s.Tweets, s.Commits, s.Retries, s.Failures+s.ErrorsDgraph+s.Overloaded,
+		avg.Seconds()*1000, p99.Seconds()*1000, rate)
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// bulkExport is nil unless -bulk_export is set.
+var bulkExport *rdfWriter
+
+// rdfWriter writes tweets as N-Quads for the dgraph bulk loader, along with the schema.
+// Nodes are named with blank nodes derived from their keys, so that the bulk loader
+// maps every user, tweet and hashtag to a single node across the whole file.
+type rdfWriter struct {
+	sync.Mutex
+	fd     *os.File
+	gz     *gzip.Writer
+	w      *bufio.Writer
+	tweets uint32
+}
+
+func newRDFWriter(dir string) *rdfWriter {
+	checkFatal(os.MkdirAll(dir, 0755), "error in creating bulk export directory: %v", dir)
+
+	schemaPath := filepath.Join(dir, "flock.schema")
+	err := ioutil.WriteFile(schemaPath, []byte(opts.Schema), 0644)
+	checkFatal(err, "error in writing schema file: %v", schemaPath)
+
+	dataPath := filepath.Join(dir, "flock.rdf.gz")
+	fd, err := os.Create(dataPath)
+	checkFatal(err, "error in creating bulk export file: %v", dataPath)
+
+	gz := gzip.NewWriter(fd)
+	infof("Exporting tweets to %v and the schema to %v\n", dataPath, schemaPath)
+	return &rdfWriter{fd: fd, gz: gz, w: bufio.NewWriter(gz)}
+}
+
+// write converts the tweet into N-Quads and appends them to the file.
+func (r *rdfWriter) write(tweet *twitterTweet) error {
+	nquads, err := tweetNQuads(tweet)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	atomic.AddUint32(&r.tweets, 1)
+	_, err = r.w.Write(nquads)
+	return err
+}
+
+// tweetNQuads names the nodes of the tweet and converts its mutation into N-Quads.
+func tweetNQuads(tweet *twitterTweet) ([]byte, error) {
+	blankNodeIDs(tweet)
+	jsn, err := marshalMutation(tweet)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(jsn))
+	dec.UseNumber()
+	var node map[string]interface{}
+	if err := dec.Decode(&node); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := writeNQuads(&buf, node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *rdfWriter) close() {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	checkFatal(r.w.Flush(), "error in flushing bulk export file")
+	checkFatal(r.gz.Close(), "error in flushing bulk export file")
+	checkFatal(r.fd.Close(), "error in closing bulk export file")
+	infof("Exported %d tweets\n", atomic.LoadUint32(&r.tweets))
+}
+
+// blankNodeIDs names the nodes of the tweet after their keys.
+func blankNodeIDs(tweet *twitterTweet) {
+	tweet.UID = "_:tweet." + tweet.IDStr
+	tweet.Author.UID = "_:user." + tweet.Author.UserID
+	for i := range tweet.Mention {
+		tweet.Mention[i].UID = "_:user." + tweet.Mention[i].UserID
+	}
+	for i := range tweet.Tagged {
+		// hashtags can hold any character, unlike blank node names
+		tweet.Tagged[i].UID = "_:tag." + hex.EncodeToString([]byte(tweet.Tagged[i].Tag))
+	}
+	if tweet.ReplyTo != nil {
+		tweet.ReplyTo.UID = "_:tweet." + tweet.ReplyTo.IDStr
+	}
+	if tweet.ReplyToUser != nil {
+		tweet.ReplyToUser.UID = "_:user." + tweet.ReplyToUser.UserID
+	}
+}
+
+// writeNQuads writes the predicates of a node of a JSON mutation, and of the nodes it
+// links to, as N-Quads. It returns the name of the node. Keys of the form pred|facet
+// are written as facets of pred.
+func writeNQuads(buf *bytes.Buffer, node map[string]interface{}) (string, error) {
+	subject, ok := node["uid"].(string)
+	if !ok {
+		return "", fmt.Errorf("node without a blank node name: %v", node)
+	}
+
+	facets := make(map[string][]string)
+	keys := make([]string, 0, len(node))
+	for key, val := range node {
+		if i := strings.Index(key, "|"); i >= 0 {
+			facets[key[:i]] = append(facets[key[:i]], key[i+1:]+"="+facetValue(val))
+			continue
+		}
+		if key != "uid" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, pred := range keys {
+		vals, ok := node[pred].([]interface{})
+		if !ok {
+			vals = []interface{}{node[pred]}
+		}
+
+		var facet string
+		if len(facets[pred]) > 0 {
+			sort.Strings(facets[pred])
+			facet = " (" + strings.Join(facets[pred], ", ") + ")"
+		}
+
+		for _, val := range vals {
+			var object string
+			switch v := val.(type) {
+			case map[string]interface{}:
+				child, err := writeNQuads(buf, v)
+				if err != nil {
+					return "", err
+				}
+				object = child
+			case string:
+				quoted, _ := json.Marshal(v)
+				object = string(quoted)
+			case nil:
+				continue
+			default:
+				object = fmt.Sprintf("%q", fmt.Sprint(v))
+			}
+
+			fmt.Fprintf(buf, "%s <%s> %s%s .\n", subject, pred, object, facet)
+		}
+	}
+
+	return subject, nil
+}
+
+// facetValue formats the value of a facet, times are left unquoted to be typed as such.
+func facetValue(val interface{}) string {
+	s := fmt.Sprint(val)
+	if str, ok := val.(string); ok {
+		if _, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return str
+		}
+		quoted, _ := json.Marshal(str)
+		return string(quoted)
+	}
+	return s
+}
+
+// runExporter parses tweets and writes them to the bulk export file.
+func runExporter(c *y.Closer, tweets <-chan interface{}, work *interface{}) {
+	for {
+		ingestion.wait(c)
+
+		select {
+		case <-c.HasBeenClosed():
+			return
+
+		case jsn, more := <-tweets:
+			if !more {
+				return
+			}
+
+			*work = jsn
+			atomic.AddUint32(&stats.Tweets, 1)
+
+			ft, err := filterTweet(jsn)
+			if err == errFiltered || err == errNotATweet {
+				continue
+			}
+			if err != nil {
+				atomic.AddUint32(&stats.ErrorsJSON, 1)
+				continue
+			}
+
+			if err := bulkExport.write(ft); err != nil {
+				checkFatal(err, "error in writing bulk export file")
+			}
+		}
+	}
+}
+
+func startExporters(tweetChannel chan interface{}) *y.Closer {
+	bulkExport = newRDFWriter(opts.BulkExportDir)
+
+	c := y.NewCloser(0)
+	for i := 0; i < opts.NumClients; i++ {
+		c.AddRunning(1)
+		go supervise(c, "exporter", func(work *interface{}) {
+			runExporter(c, tweetChannel, work)
+		})
+	}
+
+	return c
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteNQuads(t *testing.T) {
+	cases := []struct {
+		name string
+		// either a node of a JSON mutation, or tweets exported one after the other
+		node   map[string]interface{}
+		tweets []*twitterTweet
+		want   string
+	}{
+		{
+			name: "values",
+			node: map[string]interface{}{
+				"uid":     "_:a",
+				"name":    `say "hi"`,
+				"count":   json.Number("3"),
+				"retweet": false,
+				"urls":    []interface{}{"b", "c"},
+				"missing": nil,
+			},
+			want: `_:a <count> "3" .
+_:a <name> "say \"hi\"" .
+_:a <retweet> "false" .
+_:a <urls> "b" .
+_:a <urls> "c" .
+`,
+		},
+		{
+			name: "facets",
+			node: map[string]interface{}{
+				"uid":                         "_:user.11",
+				"followers_count":             json.Number("5"),
+				"followers_count|observed_at": "2006-01-02T15:04:05Z",
+				"followers_count|source":      "stream",
+			},
+			want: `_:user.11 <followers_count> "5" (observed_at=2006-01-02T15:04:05Z, source="stream") .
+`,
+		},
+		{
+			name: "nested nodes",
+			node: map[string]interface{}{
+				"uid":    "_:tweet.1",
+				"author": map[string]interface{}{"uid": "_:user.11", "user_id": "11"},
+				"mention": []interface{}{
+					map[string]interface{}{"uid": "_:user.22", "user_id": "22"},
+					map[string]interface{}{"uid": "_:user.33", "user_id": "33"},
+				},
+			},
+			want: `_:user.11 <user_id> "11" .
+_:tweet.1 <author> _:user.11 .
+_:user.22 <user_id> "22" .
+_:tweet.1 <mention> _:user.22 .
+_:user.33 <user_id> "33" .
+_:tweet.1 <mention> _:user.33 .
+`,
+		},
+		{
+			name: "hashtag blank nodes",
+			tweets: []*twitterTweet{{
+				IDStr:     "1",
+				CreatedAt: "2006-01-02T15:04:05Z",
+				Author:    twitterUser{UserID: "11"},
+				Tagged:    []twitterHashtag{{Tag: "go lang"}, {Tag: "日本"}},
+			}},
+			want: `_:user.11 <user_id> "11" .
+_:tweet.1 <author> _:user.11 .
+_:tweet.1 <created_at> "2006-01-02T15:04:05Z" .
+_:tweet.1 <id_str> "1" .
+_:tweet.1 <retweet> "false" .
+_:tag.676f206c616e67 <tag> "go lang" .
+_:tweet.1 <tagged> _:tag.676f206c616e67 .
+_:tag.e697a5e69cac <tag> "日本" .
+_:tweet.1 <tagged> _:tag.e697a5e69cac .
+`,
+		},
+		{
+			name: "user repeated across tweets",
+			tweets: []*twitterTweet{{
+				IDStr:     "1",
+				CreatedAt: "2006-01-02T15:04:05Z",
+				Author:    twitterUser{UserID: "11"},
+				Mention:   []twitterUser{{UserID: "22"}},
+			}, {
+				IDStr:     "2",
+				CreatedAt: "2006-01-02T15:04:05Z",
+				Author:    twitterUser{UserID: "22"},
+			}},
+			want: `_:user.11 <user_id> "11" .
+_:tweet.1 <author> _:user.11 .
+_:tweet.1 <created_at> "2006-01-02T15:04:05Z" .
+_:tweet.1 <id_str> "1" .
+_:user.22 <user_id> "22" .
+_:tweet.1 <mention> _:user.22 .
+_:tweet.1 <retweet> "false" .
+_:user.22 <user_id> "22" .
+_:tweet.2 <author> _:user.22 .
+_:tweet.2 <created_at> "2006-01-02T15:04:05Z" .
+_:tweet.2 <id_str> "2" .
+_:tweet.2 <retweet> "false" .
+`,
+		},
+	}
+
+	for _, c := range cases {
+		resetGlobals()
+
+		var buf bytes.Buffer
+		if c.node != nil {
+			subject, err := writeNQuads(&buf, c.node)
+			if err != nil {
+				t.Fatalf("%s: unable to write n-quads: %v", c.name, err)
+			}
+			if subject != c.node["uid"] {
+				t.Errorf("%s: expected subject %v, got %v", c.name, c.node["uid"], subject)
+			}
+		}
+		for _, tweet := range c.tweets {
+			nquads, err := tweetNQuads(tweet)
+			if err != nil {
+				t.Fatalf("%s: unable to write n-quads: %v", c.name, err)
+			}
+			buf.Write(nquads)
+		}
+
+		if buf.String() != c.want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", c.name, c.want, buf.String())
+		}
+	}
+}
+
+func TestWriteNQuadsWithoutBlankNode(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := writeNQuads(&buf, map[string]interface{}{"name": "a"}); err == nil {
+		t.Errorf("expected an error for a node without a blank node name, got %s", buf.String())
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,11 +20,23 @@ import (
 	"google.golang.org/grpc"
 )
 
+const (
+	// cNestedFirst bounds the number of nodes expanded at each level of nested queries.
+	cNestedFirst = 10
+
+	// cReplyDepth bounds the number of tweets walked up a reply chain.
+	cReplyDepth = 10
+)
+
 var (
 	opts  progOptions
 	stats progStats
 
+	// queriesLeft is the number of queries left to run with -total_queries.
+	queriesLeft int64
+
 	errInvalidResponse = errors.New("response from Dgraph is unexpected")
+	errIndexMismatch   = errors.New("indexed lookup doesn't match the scan")
 )
 
 type progOptions struct {
@@ -32,11 +45,24 @@ type progOptions struct {
 	ReportPeriodSecs int
 	NumQueryAtATime  int
 	AlphaSockAddr    []string
+	Region           string
+	TxnBatch         int
+	QueriesPerParam  int
+	TotalQueries     int64
+	SharedQueue      bool
+	MentionFirst     int
+	ParamRetries     int
+	StoreReplies     bool
+	StoreSensitive   bool
+	StoreWithheld    bool
+	StoreEngagement  bool
 }
 
 type progStats struct {
-	Success  uint32
-	Failures uint32
+	Success    uint32
+	Failures   uint32
+	Fallbacks  uint32
+	Mismatches uint32
 }
 
 type twitterUser struct {
@@ -67,14 +93,111 @@ type twitterTweet struct {
 	Author     twitterUser   `json:"author,omitempty"`
 	Mention    []twitterUser `json:"mention,omitempty"`
 	Retweet    bool          `json:"retweet,omitempty"`
+	ReplyTo    *twitterTweet `json:"reply_to,omitempty"`
+
+	FavoriteCount     int      `json:"favorite_count,omitempty"`
+	PossiblySensitive bool     `json:"possibly_sensitive,omitempty"`
+	WithheldCountries []string `json:"withheld_countries,omitempty"`
+	WithheldScope     string   `json:"withheld_scope,omitempty"`
+}
+
+// regionalClients prefers the alphas in the local region for queries and falls back
+// to the alphas in the other regions when a query against the local ones fails.
+type regionalClients struct {
+	local  *dgo.Dgraph
+	remote *dgo.Dgraph
+
+	localTxn  batchedTxn
+	remoteTxn batchedTxn
+}
+
+// batchedTxn is a read-only txn reused for -txn_batch queries, saving the round trip
+// to get a timestamp for each of them. The queries all read the same snapshot.
+type batchedTxn struct {
+	txn  *dgo.Txn
+	uses int
+}
+
+func (b *batchedTxn) get(dgr *dgo.Dgraph) *dgo.Txn {
+	if b.txn == nil || b.uses >= opts.TxnBatch {
+		b.txn = dgr.NewReadOnlyTxn()
+		b.uses = 0
+	}
+
+	b.uses++
+	return b.txn
+}
+
+func newRegionalClients(local, remote []api.DgraphClient) *regionalClients {
+	rc := &regionalClients{}
+	if len(local) > 0 {
+		rc.local = dgo.NewDgraphClient(local...)
+	}
+	if len(remote) > 0 {
+		rc.remote = dgo.NewDgraphClient(remote...)
+	}
+
+	return rc
+}
+
+func (rc *regionalClients) run(fn func(dgr *dgo.Dgraph) error) error {
+	if rc.local == nil {
+		return fn(rc.remote)
+	}
+
+	err := fn(rc.local)
+	if err == nil || err == errInvalidResponse || err == errIndexMismatch || rc.remote == nil {
+		return err
+	}
+
+	atomic.AddUint32(&stats.Fallbacks, 1)
+	log.Printf("query failed on local alphas, falling back to remote :: %v", err)
+	return fn(rc.remote)
+}
+
+// runInTxn is like run, with a read-only txn of the alphas that is reused across queries.
+func (rc *regionalClients) runInTxn(fn func(txn *dgo.Txn) error) error {
+	return rc.run(func(dgr *dgo.Dgraph) error {
+		b := &rc.localTxn
+		if dgr == rc.remote {
+			b = &rc.remoteTxn
+		}
+
+		err := fn(b.get(dgr))
+		if err != nil {
+			// start afresh after an error, the txn may be the cause
+			b.txn = nil
+		}
+		return err
+	})
+}
+
+// splitAlphasByRegion splits the addresses into the ones in the given region and the
+// rest. Addresses are optionally tagged with a region as region=addr. All addresses
+// are considered local when no region is given.
+func splitAlphasByRegion(sockAddr []string, region string) (local, remote []string) {
+	for _, sa := range sockAddr {
+		label := ""
+		if i := strings.Index(sa, "="); i >= 0 {
+			label, sa = sa[:i], sa[i+1:]
+		}
+
+		if region == "" || label == region {
+			local = append(local, sa)
+		} else {
+			remote = append(remote, sa)
+		}
+	}
+
+	return local, remote
 }
 
 // dgraphQuery interface represents an agent query
 type dgraphQuery interface {
 	// getParams is called infrequently to query parameters for the actual query
 	getParams(dgr *dgo.Dgraph) error
-	// runQuery runs the actual query
-	runQuery(dgr *dgo.Dgraph) error
+	// runQuery runs the actual query, in a read-only txn that may be shared with other queries
+	runQuery(txn *dgo.Txn) error
 }
 
 // Query Type 1
@@ -83,16 +206,17 @@ type queryOne struct {
 }
 
 func (q *queryOne) getParams(dgr *dgo.Dgraph) error {
-	query := fmt.Sprintf(`
-{
-  dataquery(func:has(hashtags), first: 100, offset: %v) {
+	query := `
+query all($offset: int) {
+  dataquery(func:has(hashtags), first: 100, offset: $offset) {
     hashtags
   }
 }
-`, rand.Intn(1000))
+`
 
 	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(1000))})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -128,7 +252,7 @@ func (q *queryOne) getParams(dgr *dgo.Dgraph) error {
 	return nil
 }
 
-func (q *queryOne) runQuery(dgr *dgo.Dgraph) error {
+func (q *queryOne) runQuery(txn *dgo.Txn) error {
 	const query = `
 query all($tagVal: string) {
   dataquery(func: eq(hashtags, $tagVal))
@@ -142,7 +266,6 @@ query all($tagVal: string) {
 }
 `
 	hashtag := q.hashtags[rand.Intn(len(q.hashtags))]
-	txn := dgr.NewReadOnlyTxn()
 	resp, err := txn.QueryWithVars(context.Background(), query,
 		map[string]string{"$tagVal": hashtag})
 	if err != nil {
@@ -194,16 +317,17 @@ type queryTwo struct {
 }
 
 func (q *queryTwo) getParams(dgr *dgo.Dgraph) error {
-	query := fmt.Sprintf(`
-{
-  dataquery(func: has(screen_name), first: 100, offset: %v) {
+	query := `
+query all($offset: int) {
+  dataquery(func: has(screen_name), first: 100, offset: $offset) {
     screen_name
   }
 }
-`, rand.Intn(1000))
+`
 
 	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(1000))})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -237,7 +361,7 @@ func (q *queryTwo) getParams(dgr *dgo.Dgraph) error {
 	return nil
 }
 
-func (q *queryTwo) runQuery(dgr *dgo.Dgraph) error {
+func (q *queryTwo) runQuery(txn *dgo.Txn) error {
 	const query = `
 query all($screenName: string) {
   dataquery(func: eq(screen_name, $screenName)) {
@@ -254,7 +378,6 @@ query all($screenName: string) {
 }
 `
 	screenName := q.screenNames[rand.Intn(len(q.screenNames))]
-	txn := dgr.NewReadOnlyTxn()
 	resp, err := txn.QueryWithVars(context.Background(), query,
 		map[string]string{"$screenName": screenName})
 	if err != nil {
@@ -298,16 +421,16 @@ func (q *queryThree) getParams(dgr *dgo.Dgraph) error {
 	return nil
 }
 
-func (q *queryThree) runQuery(dgr *dgo.Dgraph) error {
-	query := fmt.Sprintf(`
-{
+func (q *queryThree) runQuery(txn *dgo.Txn) error {
+	query := `
+query all($offset: int) {
   var(func: has(<~mention>)) {
     ~mention @groupby(mention) {
       a as count(uid)
     }
   }
 
-  dataquery(func: uid(a), orderdesc: val(a), first: 100, offset: %v) {
+  dataquery(func: uid(a), orderdesc: val(a), first: 100, offset: $offset) {
     uid
     screen_name
     user_id
@@ -320,10 +443,10 @@ func (q *queryThree) runQuery(dgr *dgo.Dgraph) error {
     total_mentions : val(a)
   }
 }
-`, rand.Intn(10))
+`
 
-	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(10))})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -346,7 +469,9 @@ func (q *queryThree) runQuery(dgr *dgo.Dgraph) error {
 	for _, t := range r.QueryData {
 		if prevValue != -1 && prevValue < t.TotalMentions {
 			log.Printf("the mentions are not sorted, resp: %v", t)
+			return errInvalidResponse
 		}
+		prevValue = t.TotalMentions
 
 		if t.UID == "" || t.UserID == "" {
 			log.Printf("response is empty :: %+v", t)
@@ -364,14 +489,14 @@ func (q *queryFour) getParams(dgr *dgo.Dgraph) error {
 	return nil
 }
 
-func (q *queryFour) runQuery(dgr *dgo.Dgraph) error {
-	query := fmt.Sprintf(`
-{
+func (q *queryFour) runQuery(txn *dgo.Txn) error {
+	query := `
+query all($offset: int) {
   var(func: has(user_id)) {
     a as count(~author)
   }
 
-  dataquery(func: uid(a), orderdesc: val(a), first: 100, offset: %v) {
+  dataquery(func: uid(a), orderdesc: val(a), first: 100, offset: $offset) {
     uid
     screen_name
     user_id
@@ -384,10 +509,10 @@ func (q *queryFour) runQuery(dgr *dgo.Dgraph) error {
     total_tweets : val(a)
   }
 }
-`, rand.Intn(1000))
+`
 
-	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(1000))})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -410,7 +535,9 @@ func (q *queryFour) runQuery(dgr *dgo.Dgraph) error {
 	for _, t := range r.QueryData {
 		if prevValue != -1 && prevValue < t.TotalTweets {
 			log.Printf("the users are not sorted, resp: %v", t)
+			return errInvalidResponse
 		}
+		prevValue = t.TotalTweets
 
 		if t.UID == "" || t.UserID == "" {
 			log.Printf("response is empty :: %+v", t)
@@ -427,16 +554,17 @@ type queryFive struct {
 }
 
 func (q *queryFive) getParams(dgr *dgo.Dgraph) error {
-	query := fmt.Sprintf(`
-{
-  dataquery(func: has(user_id), first: 100, offset: %v) {
+	query := `
+query all($offset: int) {
+  dataquery(func: has(user_id), first: 100, offset: $offset) {
     user_id
   }
 }
-`, rand.Intn(1000))
+`
 
 	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(1000))})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -470,7 +598,7 @@ func (q *queryFive) getParams(dgr *dgo.Dgraph) error {
 	return nil
 }
 
-func (q *queryFive) runQuery(dgr *dgo.Dgraph) error {
+func (q *queryFive) runQuery(txn *dgo.Txn) error {
 	const query = `
 query all($userID: string) {
   dataquery(func: eq(user_id, $userID)) {
@@ -487,7 +615,6 @@ query all($userID: string) {
 }
 `
 	userID := q.userIDs[rand.Intn(len(q.userIDs))]
-	txn := dgr.NewReadOnlyTxn()
 	resp, err := txn.QueryWithVars(context.Background(), query,
 		map[string]string{"$userID": userID})
 	if err != nil {
@@ -533,17 +660,20 @@ func (q *querySix) getParams(dgr *dgo.Dgraph) error {
 	// we subtract 41 hours because that's the latest data we get from twitter
 	curTime := time.Now().Add(-41 * time.Hour)
 
-	query := fmt.Sprintf(`
-{
-  dataquery(func:has(hashtags), first: 100, offset: %v) @filter(ge(created_at, "%v")) {
+	query := `
+query all($since: string, $offset: int) {
+  dataquery(func:has(hashtags), first: 100, offset: $offset) @filter(ge(created_at, $since)) {
     hashtags
     created_at
   }
 }
-`, rand.Intn(1000), curTime.Format(time.RFC3339))
+`
 
 	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$since":  curTime.Format(time.RFC3339),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -602,19 +732,22 @@ func (q *querySeven) getParams(dgr *dgo.Dgraph) error {
 	// we subtract 41 hours because that's the latest data we get from twitter
 	curTime := time.Now().Add(-41 * time.Hour)
 
-	query := fmt.Sprintf(`
-{
-  dataquery(func: has(screen_name), first: 100, offset: %v) @cascade {
+	query := `
+query all($since: string, $offset: int) {
+  dataquery(func: has(screen_name), first: 100, offset: $offset) @cascade {
     screen_name
-    ~author @filter(ge(created_at, "%v")) {
+    ~author @filter(ge(created_at, $since)) {
       created_at
     }
   }
 }
-`, rand.Intn(1000), curTime.Format(time.RFC3339))
+`
 
 	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$since":  curTime.Format(time.RFC3339),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -667,17 +800,17 @@ type queryEight struct {
 	queryFour
 }
 
-func (q *queryEight) runQuery(dgr *dgo.Dgraph) error {
+func (q *queryEight) runQuery(txn *dgo.Txn) error {
 	// we subtract 41 hours because that's the latest data we get from twitter
 	curTime := time.Now().Add(-41 * time.Hour)
 
-	query := fmt.Sprintf(`
-{
+	query := `
+query all($since: string, $offset: int) {
   var(func: has(user_id)) {
-    a as count(~author) @filter(ge(created_at, "%v"))
+    a as count(~author) @filter(ge(created_at, $since))
   }
 
-  dataquery(func: uid(a), orderdesc: val(a), first: 100, offset: %v) @cascade {
+  dataquery(func: uid(a), orderdesc: val(a), first: 100, offset: $offset) @cascade {
     uid
     screen_name
     user_id
@@ -688,15 +821,17 @@ func (q *queryEight) runQuery(dgr *dgo.Dgraph) error {
     followers_count
     description
     total_tweets : val(a)
-    ~author @filter(ge(created_at, "%v")) {
+    ~author @filter(ge(created_at, $since)) {
       created_at
     }
   }
 }
-`, curTime.Format(time.RFC3339), rand.Intn(1000), curTime.Format(time.RFC3339))
+`
 
-	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$since":  curTime.Format(time.RFC3339),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -733,7 +868,9 @@ func (q *queryEight) runQuery(dgr *dgo.Dgraph) error {
 	for _, t := range r.QueryData {
 		if prevValue != -1 && prevValue < t.TotalTweets {
 			log.Printf("the users are not sorted, resp: %v", t)
+			return errInvalidResponse
 		}
+		prevValue = t.TotalTweets
 
 		if t.UID == "" || t.UserID == "" {
 			log.Printf("response is empty :: %+v", t)
@@ -753,19 +890,22 @@ func (q *queryNine) getParams(dgr *dgo.Dgraph) error {
 	// we subtract 41 hours because that's the latest data we get from twitter
 	curTime := time.Now().Add(-41 * time.Hour)
 
-	query := fmt.Sprintf(`
-{
-  dataquery(func: has(user_id), first: 100, offset: %v) @cascade {
+	query := `
+query all($since: string, $offset: int) {
+  dataquery(func: has(user_id), first: 100, offset: $offset) @cascade {
 		user_id
-		~author @filter(ge(created_at, "%v")) {
+		~author @filter(ge(created_at, $since)) {
       created_at
     }
   }
 }
-`, rand.Intn(1000), curTime.Format(time.RFC3339))
+`
 
 	txn := dgr.NewReadOnlyTxn()
-	resp, err := txn.Query(context.Background(), query)
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$since":  curTime.Format(time.RFC3339),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
 	if err != nil {
 		log.Printf("error in querying dgraph %T :: %v", q, err)
 		return err
@@ -813,6 +953,511 @@ func (q *queryNine) getParams(dgr *dgo.Dgraph) error {
 	return nil
 }
 
+// Query Type 10
+type queryTen struct {
+	queryFive
+}
+
+func (q *queryTen) runQuery(txn *dgo.Txn) error {
+	query := fmt.Sprintf(`
+query all($userID: string) {
+  dataquery(func: eq(user_id, $userID)) {
+    uid
+    user_id
+    screen_name
+    ~author (first: %[1]v) {
+      uid
+      id_str
+      mention (first: %[2]v) {
+        uid
+        user_id
+        ~author (first: %[1]v) {
+          uid
+          id_str
+          created_at
+        }
+      }
+    }
+  }
+}
+`, cNestedFirst, opts.MentionFirst)
+
+	userID := q.userIDs[rand.Intn(len(q.userIDs))]
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$userID": userID})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []twitterUser `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification
+	if len(r.QueryData) != 1 {
+		log.Printf("expected exactly one user for user_id %v, got: %v", userID, len(r.QueryData))
+		return errInvalidResponse
+	}
+	u := r.QueryData[0]
+	if u.UID == "" || u.UserID != userID {
+		log.Printf("user doesn't match, expected: %v, actual: %+v", userID, u)
+		return errInvalidResponse
+	}
+	if len(u.Tweet) > cNestedFirst {
+		log.Printf("too many tweets expanded, limit: %v, actual: %v", cNestedFirst, len(u.Tweet))
+		return errInvalidResponse
+	}
+	for _, t := range u.Tweet {
+		if t.UID == "" || t.IDStr == "" {
+			log.Printf("tweet is empty :: %+v", t)
+			return errInvalidResponse
+		}
+		if len(t.Mention) > opts.MentionFirst {
+			log.Printf("too many mentions expanded, limit: %v, actual: %v",
+				opts.MentionFirst, len(t.Mention))
+			return errInvalidResponse
+		}
+
+		for _, m := range t.Mention {
+			if m.UID == "" || m.UserID == "" {
+				log.Printf("mentioned user is empty :: %+v", m)
+				return errInvalidResponse
+			}
+			if len(m.Tweet) > cNestedFirst {
+				log.Printf("too many tweets expanded, limit: %v, actual: %v",
+					cNestedFirst, len(m.Tweet))
+				return errInvalidResponse
+			}
+
+			for _, mt := range m.Tweet {
+				if mt.UID == "" || mt.IDStr == "" {
+					log.Printf("tweet is empty :: %+v", mt)
+					return errInvalidResponse
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Query Type 11
+type queryEleven struct{}
+
+func (q *queryEleven) getParams(dgr *dgo.Dgraph) error {
+	return nil
+}
+
+func (q *queryEleven) runQuery(txn *dgo.Txn) error {
+	const numTweets = 1000
+	query := `
+query all($first: int, $offset: int) {
+  dataquery(func: has(author), first: $first, offset: $offset) @groupby(author) {
+    count(uid)
+  }
+}
+`
+
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$first":  strconv.Itoa(numTweets),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []struct {
+			Groups []struct {
+				Author string `json:"author"`
+				Count  int64  `json:"count"`
+			} `json:"@groupby"`
+		} `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification, dgraph returns a single @groupby block with the groups sorted by key
+	if len(r.QueryData) != 1 || len(r.QueryData[0].Groups) == 0 {
+		log.Printf("expected a single non empty @groupby block, got: %s", resp.Json)
+		return errInvalidResponse
+	}
+	prevUID := uint64(0)
+	total := int64(0)
+	for _, g := range r.QueryData[0].Groups {
+		uid, err := strconv.ParseUint(g.Author, 0, 64)
+		if err != nil || g.Count <= 0 {
+			log.Printf("invalid group :: %+v", g)
+			return errInvalidResponse
+		}
+		if uid <= prevUID {
+			log.Printf("the groups are not sorted by author, %#x before %v", prevUID, g.Author)
+			return errInvalidResponse
+		}
+		prevUID = uid
+		total += g.Count
+	}
+	if total > numTweets {
+		log.Printf("groups count %v tweets, more than the %v queried", total, numTweets)
+		return errInvalidResponse
+	}
+
+	return nil
+}
+
+// Query Type 12
+type queryTwelve struct {
+	tweetIDs []string
+}
+
+func (q *queryTwelve) getParams(dgr *dgo.Dgraph) error {
+	query := `
+query all($offset: int) {
+  dataquery(func: has(reply_to), first: 100, offset: $offset) {
+    id_str
+  }
+}
+`
+
+	txn := dgr.NewReadOnlyTxn()
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(1000))})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []twitterTweet `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// replies are only linked when flock runs with -store_replies
+	q.tweetIDs = q.tweetIDs[:0]
+	for _, t := range r.QueryData {
+		if t.IDStr != "" {
+			q.tweetIDs = append(q.tweetIDs, t.IDStr)
+		}
+	}
+	if len(q.tweetIDs) == 0 {
+		log.Printf("no replies found for query: %v", query)
+		return errInvalidResponse
+	}
+
+	return nil
+}
+
+// runQuery walks up the reply chain of a tweet.
+func (q *queryTwelve) runQuery(txn *dgo.Txn) error {
+	query := fmt.Sprintf(`
+query all($tweetID: string) {
+  dataquery(func: eq(id_str, $tweetID)) @recurse(depth: %v, loop: false) {
+    uid
+    id_str
+    reply_to
+  }
+}
+`, cReplyDepth)
+
+	tweetID := q.tweetIDs[rand.Intn(len(q.tweetIDs))]
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$tweetID": tweetID})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []twitterTweet `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification
+	if len(r.QueryData) != 1 {
+		log.Printf("expected exactly one tweet for id_str %v, got: %v", tweetID, len(r.QueryData))
+		return errInvalidResponse
+	}
+	if r.QueryData[0].IDStr != tweetID || r.QueryData[0].ReplyTo == nil {
+		log.Printf("tweet is not a reply, expected: %v, actual: %+v", tweetID, r.QueryData[0])
+		return errInvalidResponse
+	}
+	depth := 0
+	seen := make(map[string]bool)
+	for t := &r.QueryData[0]; t != nil; t = t.ReplyTo {
+		depth++
+		if t.UID == "" || t.IDStr == "" || seen[t.UID] {
+			log.Printf("invalid tweet in the reply chain of %v :: %+v", tweetID, t)
+			return errInvalidResponse
+		}
+		seen[t.UID] = true
+	}
+	if depth > cReplyDepth {
+		log.Printf("reply chain too long, limit: %v, actual: %v", cReplyDepth, depth)
+		return errInvalidResponse
+	}
+
+	return nil
+}
+
+// Query Type 13
+type queryThirteen struct{}
+
+func (q *queryThirteen) getParams(dgr *dgo.Dgraph) error {
+	return nil
+}
+
+// runQuery ranks tweets by engagement, it needs flock to run with -store_engagement.
+func (q *queryThirteen) runQuery(txn *dgo.Txn) error {
+	const numTweets = 100
+	query := `
+query all($first: int) {
+  dataquery(func: has(favorite_count), orderdesc: favorite_count, first: $first) {
+    uid
+    id_str
+    favorite_count
+  }
+}
+`
+
+	resp, err := txn.QueryWithVars(context.Background(), query,
+		map[string]string{"$first": strconv.Itoa(numTweets)})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []twitterTweet `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification
+	if len(r.QueryData) > numTweets {
+		log.Printf("too many tweets returned, limit: %v, actual: %v", numTweets, len(r.QueryData))
+		return errInvalidResponse
+	}
+	for i, t := range r.QueryData {
+		if t.UID == "" || t.IDStr == "" {
+			log.Printf("tweet is empty :: %+v", t)
+			return errInvalidResponse
+		}
+		if i > 0 && t.FavoriteCount > r.QueryData[i-1].FavoriteCount {
+			log.Printf("tweets are not ordered by favorite_count, %v before %v",
+				r.QueryData[i-1].FavoriteCount, t.FavoriteCount)
+			return errInvalidResponse
+		}
+	}
+
+	return nil
+}
+
+// Query Type 14
+type queryFourteen struct{}
+
+func (q *queryFourteen) getParams(dgr *dgo.Dgraph) error {
+	return nil
+}
+
+// runQuery finds the tweets that are flagged as possibly sensitive, it needs flock to
+// run with -store_sensitive.
+func (q *queryFourteen) runQuery(txn *dgo.Txn) error {
+	const numTweets = 100
+	query := `
+query all($first: int, $offset: int) {
+  dataquery(func: eq(possibly_sensitive, true), first: $first, offset: $offset) {
+    uid
+    id_str
+    possibly_sensitive
+  }
+}
+`
+
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$first":  strconv.Itoa(numTweets),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []twitterTweet `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification
+	if len(r.QueryData) > numTweets {
+		log.Printf("too many tweets returned, limit: %v, actual: %v", numTweets, len(r.QueryData))
+		return errInvalidResponse
+	}
+	for _, t := range r.QueryData {
+		if t.UID == "" || t.IDStr == "" || !t.PossiblySensitive {
+			log.Printf("tweet is not possibly sensitive :: %+v", t)
+			return errInvalidResponse
+		}
+	}
+
+	return nil
+}
+
+// Query Type 15
+type queryFifteen struct{}
+
+func (q *queryFifteen) getParams(dgr *dgo.Dgraph) error {
+	return nil
+}
+
+// runQuery finds the tweets withheld in some countries, it needs flock to run with
+// -store_withheld.
+func (q *queryFifteen) runQuery(txn *dgo.Txn) error {
+	const numTweets = 100
+	query := `
+query all($first: int, $offset: int) {
+  dataquery(func: has(withheld_countries), first: $first, offset: $offset) {
+    uid
+    id_str
+    withheld_countries
+    withheld_scope
+  }
+}
+`
+
+	resp, err := txn.QueryWithVars(context.Background(), query, map[string]string{
+		"$first":  strconv.Itoa(numTweets),
+		"$offset": strconv.Itoa(rand.Intn(1000)),
+	})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var r struct {
+		QueryData []twitterTweet `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification
+	if len(r.QueryData) > numTweets {
+		log.Printf("too many tweets returned, limit: %v, actual: %v", numTweets, len(r.QueryData))
+		return errInvalidResponse
+	}
+	for _, t := range r.QueryData {
+		if t.UID == "" || t.IDStr == "" || len(t.WithheldCountries) == 0 {
+			log.Printf("tweet is not withheld :: %+v", t)
+			return errInvalidResponse
+		}
+	}
+
+	return nil
+}
+
+// Query Type 16
+type querySixteen struct{}
+
+func (q *querySixteen) getParams(dgr *dgo.Dgraph) error {
+	return nil
+}
+
+// runQuery looks up a user found by scanning has(screen_name) with eq(screen_name), both
+// in the same txn, to catch stale or missing index entries.
+func (q *querySixteen) runQuery(txn *dgo.Txn) error {
+	const scanQuery = `
+query all($offset: int) {
+  dataquery(func: has(screen_name), first: 100, offset: $offset) {
+    uid
+    screen_name
+  }
+}
+`
+	resp, err := txn.QueryWithVars(context.Background(), scanQuery,
+		map[string]string{"$offset": strconv.Itoa(rand.Intn(1000))})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var scan struct {
+		QueryData []twitterUser `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &scan); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+	if len(scan.QueryData) == 0 {
+		log.Printf("no users found for query: %v", scanQuery)
+		return errInvalidResponse
+	}
+
+	// every user the scan found with the screen name has to be found by the index
+	expected := scan.QueryData[rand.Intn(len(scan.QueryData))]
+	const indexQuery = `
+query all($screenName: string) {
+  dataquery(func: eq(screen_name, $screenName)) {
+    uid
+    screen_name
+  }
+}
+`
+	resp, err = txn.QueryWithVars(context.Background(), indexQuery,
+		map[string]string{"$screenName": expected.ScreenName})
+	if err != nil {
+		log.Printf("error in querying dgraph %T :: %v", q, err)
+		return err
+	}
+
+	var index struct {
+		QueryData []twitterUser `json:"dataquery"`
+	}
+	if err := json.Unmarshal(resp.Json, &index); err != nil {
+		log.Printf("error in unmarshalling result :: %v", err)
+		return err
+	}
+
+	// verification
+	found := false
+	for _, u := range index.QueryData {
+		if u.ScreenName != expected.ScreenName {
+			log.Printf("index returned another screen name, expected: %v, actual: %+v",
+				expected.ScreenName, u)
+			return errIndexMismatch
+		}
+		if u.UID == expected.UID {
+			found = true
+		}
+	}
+	if !found {
+		log.Printf("index is missing user %v with screen name %v, found: %+v",
+			expected.UID, expected.ScreenName, index.QueryData)
+		return errIndexMismatch
+	}
+
+	return nil
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -825,11 +1470,36 @@ func main() {
 		&querySix{}, &querySix{}, &querySix{},
 		&querySeven{}, &querySeven{},
 		&queryEight{}, &queryEight{}, &queryEight{}, &queryEight{},
+		&queryTen{}, &queryTen{},
+		&queryEleven{}, &queryEleven{},
+		&querySixteen{}, &querySixteen{},
 	}
 
 	dgclients := flag.Int("l", 6, "number of dgraph clients to run")
 	queriesAtATime := flag.Int("q", 4, "number of queries running at a time")
-	alphasAddress := flag.String("a", ":9180,:9182,:9183", "comma separated addresses to alphas")
+	alphasAddress := flag.String("a", ":9180,:9182,:9183",
+		"comma separated addresses to alphas, optionally tagged with a region as region=addr")
+	region := flag.String("region", "", "region of the alphas to prefer for queries")
+	txnBatch := flag.Int("txn_batch", 1, "number of queries run in the same read-only txn")
+	queriesPerParam := flag.Int("queries_per_param", 100,
+		"number of queries run with the parameters sampled by a parameter query")
+	sharedQueue := flag.Bool("shared_queue", false,
+		"run -q workers taking the next query from a queue shared by all the query types, "+
+			"instead of a worker bound to every query")
+	mentionFirst := flag.Int("mention_first", cNestedFirst,
+		"number of mentions expanded per tweet by the nested queries")
+	paramRetries := flag.Int("param_retries", 3,
+		"number of times a failed parameter query is retried, with backoff, before failing")
+	totalQueries := flag.Int64("total_queries", 0,
+		"number of queries to run before exiting, shared by all the workers, forever if 0")
+	storeReplies := flag.Bool("store_replies", false,
+		"add the query walking up reply chains, for flock running with -store_replies")
+	storeSensitive := flag.Bool("store_sensitive", false,
+		"add the query on possibly sensitive tweets, for flock running with -store_sensitive")
+	storeWithheld := flag.Bool("store_withheld", false,
+		"add the query on withheld tweets, for flock running with -store_withheld")
+	storeEngagement := flag.Bool("store_engagement", false,
+		"add the query ranking tweets by engagement, for flock running with -store_engagement")
 	flag.Parse()
 
 	opts = progOptions{
@@ -837,9 +1507,49 @@ func main() {
 		ReportPeriodSecs: 2,
 		NumQueryAtATime:  *queriesAtATime,
 		AlphaSockAddr:    strings.Split(*alphasAddress, ","),
+		Region:           *region,
+		TxnBatch:         *txnBatch,
+		QueriesPerParam:  *queriesPerParam,
+		TotalQueries:     *totalQueries,
+		SharedQueue:      *sharedQueue,
+		MentionFirst:     *mentionFirst,
+		ParamRetries:     *paramRetries,
+		StoreReplies:     *storeReplies,
+		StoreSensitive:   *storeSensitive,
+		StoreWithheld:    *storeWithheld,
+		StoreEngagement:  *storeEngagement,
+	}
+	if opts.MentionFirst <= 0 {
+		log.Fatalf("invalid value for mention first: %v", opts.MentionFirst)
+	}
+	if opts.QueriesPerParam <= 0 {
+		log.Fatalf("invalid value for queries per param: %v", opts.QueriesPerParam)
+	}
+
+	// these queries read predicates that flock only stores with the same flags
+	if opts.StoreReplies {
+		allQueries = append(allQueries, &queryTwelve{}, &queryTwelve{})
+	}
+	if opts.StoreSensitive {
+		allQueries = append(allQueries, &queryFourteen{}, &queryFourteen{})
+	}
+	if opts.StoreWithheld {
+		allQueries = append(allQueries, &queryFifteen{}, &queryFifteen{})
+	}
+	if opts.StoreEngagement {
+		allQueries = append(allQueries, &queryThirteen{}, &queryThirteen{})
 	}
 
-	alphas, err := newAPIClients(opts.AlphaSockAddr)
+	localAddr, remoteAddr := splitAlphasByRegion(opts.AlphaSockAddr, opts.Region)
+	if len(localAddr) == 0 {
+		log.Printf("no alphas found in region %v, using all alphas", opts.Region)
+	}
+	localAlphas, err := newAPIClients(localAddr)
+	if err != nil {
+		log.Println("error in creating dgraph clients ::", err)
+		panic(err)
+	}
+	remoteAlphas, err := newAPIClients(remoteAddr)
 	if err != nil {
 		log.Println("error in creating dgraph clients ::", err)
 		panic(err)
@@ -851,29 +1561,44 @@ func main() {
 		opts.NumDgrClients, len(opts.AlphaSockAddr))
 
 	// run queries
+	queriesLeft = opts.TotalQueries
+	start := time.Now()
 	var wg sync.WaitGroup
-	th := y.NewThrottle(opts.NumQueryAtATime)
-	for _, query := range allQueries {
-		wg.Add(1)
-		go runQuery(alphas, &wg, th, query)
+	if opts.SharedQueue {
+		// query types are repeated in allQueries by their weight, so is the queue
+		queue := make(chan *queuedQuery, len(allQueries))
+		for _, i := range rand.Perm(len(allQueries)) {
+			queue <- &queuedQuery{query: allQueries[i]}
+		}
+		for i := 0; i < opts.NumQueryAtATime; i++ {
+			wg.Add(1)
+			go runQueue(localAlphas, remoteAlphas, &wg, queue)
+		}
+	} else {
+		th := y.NewThrottle(opts.NumQueryAtATime)
+		for _, query := range allQueries {
+			wg.Add(1)
+			go runQuery(localAlphas, remoteAlphas, &wg, th, query)
+		}
 	}
 
 	wg.Wait()
+	reportSummary(time.Since(start))
 }
 
-func runQuery(alphas []api.DgraphClient, wg *sync.WaitGroup,
+func runQuery(localAlphas, remoteAlphas []api.DgraphClient, wg *sync.WaitGroup,
 	th *y.Throttle, query dgraphQuery) {
 
 	defer wg.Done()
 
-	dgr := dgo.NewDgraphClient(alphas...)
+	rc := newRegionalClients(localAlphas, remoteAlphas)
 	for {
-		// run parameter query
-		th.Do()
-		err := query.getParams(dgr)
-		th.Done(nil)
+		if opts.TotalQueries > 0 && atomic.LoadInt64(&queriesLeft) <= 0 {
+			return
+		}
 
-		if err != nil {
+		// run parameter query
+		if err := runParams(rc, th, query); err != nil {
 			atomic.AddUint32(&stats.Failures, 1)
 			log.Printf("error in running parameter query %T :: %v", query, err)
 			continue
@@ -882,13 +1607,17 @@ func runQuery(alphas []api.DgraphClient, wg *sync.WaitGroup,
 		atomic.AddUint32(&stats.Success, 1)
 
 		// run actual queries
-		for i := 0; i < 100; i++ {
+		for i := 0; i < opts.QueriesPerParam; i++ {
+			if !takeQuery() {
+				return
+			}
+
 			th.Do()
-			err := query.runQuery(dgr)
+			err := rc.runInTxn(query.runQuery)
 			th.Done(nil)
 
 			if err != nil {
-				atomic.AddUint32(&stats.Failures, 1)
+				countFailure(err)
 				log.Printf("error in running query :: %v", err)
 				continue
 			}
@@ -898,6 +1627,108 @@ func runQuery(alphas []api.DgraphClient, wg *sync.WaitGroup,
 	}
 }
 
+// queuedQuery is a query in the shared queue, along with the number of times it ran
+// with its current parameters.
+type queuedQuery struct {
+	query dgraphQuery
+	runs  int
+}
+
+// runQueue runs the queries of the shared queue one at a time, putting each back at the
+// end of the queue once it ran, so that a slow query type doesn't hold on to a worker.
+func runQueue(localAlphas, remoteAlphas []api.DgraphClient, wg *sync.WaitGroup,
+	queue chan *queuedQuery) {
+
+	defer wg.Done()
+
+	rc := newRegionalClients(localAlphas, remoteAlphas)
+	for {
+		q := <-queue
+		more := runQueued(rc, q)
+		queue <- q
+		if !more {
+			return
+		}
+	}
+}
+
+// runQueued runs a query, after refreshing its parameters every -queries_per_param
+// runs, and reports whether more queries may run.
+func runQueued(rc *regionalClients, q *queuedQuery) bool {
+	if q.runs%opts.QueriesPerParam == 0 {
+		if err := runParams(rc, nil, q.query); err != nil {
+			atomic.AddUint32(&stats.Failures, 1)
+			log.Printf("error in running parameter query %T :: %v", q.query, err)
+			return opts.TotalQueries <= 0 || atomic.LoadInt64(&queriesLeft) > 0
+		}
+
+		atomic.AddUint32(&stats.Success, 1)
+		q.runs = 0
+	}
+
+	if !takeQuery() {
+		return false
+	}
+
+	q.runs++
+	if err := rc.runInTxn(q.query.runQuery); err != nil {
+		countFailure(err)
+		log.Printf("error in running query :: %v", err)
+		return true
+	}
+
+	atomic.AddUint32(&stats.Success, 1)
+	return true
+}
+
+// runParams runs the parameter query of a query, retrying it -param_retries times with
+// backoff, so that transient errors such as those while the cluster warms up don't fail it.
+// The throttle, if any, is only held while the query runs so that the backoff doesn't take
+// a slot away from the other queries.
+func runParams(rc *regionalClients, th *y.Throttle, query dgraphQuery) error {
+	delay := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		if th != nil {
+			th.Do()
+		}
+		err := rc.run(query.getParams)
+		if th != nil {
+			th.Done(nil)
+		}
+		if err == nil || i >= opts.ParamRetries {
+			return err
+		}
+
+		log.Printf("retrying parameter query %T in %v :: %v", query, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// countFailure counts index mismatches apart from the other failures.
+func countFailure(err error) {
+	if err == errIndexMismatch {
+		atomic.AddUint32(&stats.Mismatches, 1)
+	} else {
+		atomic.AddUint32(&stats.Failures, 1)
+	}
+}
+
+// takeQuery reports whether another query may run, it is always true without
+// -total_queries.
+func takeQuery() bool {
+	return opts.TotalQueries <= 0 || atomic.AddInt64(&queriesLeft, -1) >= 0
+}
+
+// reportSummary prints the stats of the whole run.
+func reportSummary(elapsed time.Duration) {
+	success := atomic.LoadUint32(&stats.Success)
+	log.Printf("SUMMARY ran for %v, success: %d, failures: %d, fallbacks: %d, mismatches: %d, "+
+		"query_rate: %.2f/sec", elapsed.Round(time.Millisecond), success,
+		atomic.LoadUint32(&stats.Failures), atomic.LoadUint32(&stats.Fallbacks),
+		atomic.LoadUint32(&stats.Mismatches), float64(success)/elapsed.Seconds())
+}
+
 // TODO: fix the race condition here
 func reportStats() {
 	var oldStats, newStats progStats
@@ -907,8 +1738,9 @@ func reportStats() {
 
 		oldStats = newStats
 		newStats = stats
-		log.Printf("STATS success: %d, failures: %d, query_rate: %d/sec",
-			newStats.Success, newStats.Failures,
+		log.Printf("STATS success: %d, failures: %d, fallbacks: %d, mismatches: %d, "+
+			"query_rate: %d/sec", newStats.Success, newStats.Failures, newStats.Fallbacks,
+			newStats.Mismatches,
 			(newStats.Success-oldStats.Success)/uint32(opts.ReportPeriodSecs))
 	}
 }
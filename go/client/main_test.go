@@ -0,0 +1,94 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"google.golang.org/grpc"
+)
+
+// cannedDgraph is an api.DgraphClient answering every query with the same response.
+type cannedDgraph struct {
+	api.DgraphClient
+	resp []byte
+}
+
+func (c *cannedDgraph) Query(ctx context.Context, in *api.Request,
+	opts ...grpc.CallOption) (*api.Response, error) {
+
+	return &api.Response{Json: c.resp}, nil
+}
+
+// userRows returns the dataquery of users with the given totals, along with a recent
+// tweet each.
+func userRows(t *testing.T, totals ...int64) []byte {
+	t.Helper()
+
+	recent := time.Now().Format(time.RFC3339)
+	var users []twitterUser
+	for i, total := range totals {
+		users = append(users, twitterUser{
+			UID:           fmt.Sprintf("0x%x", i+1),
+			UserID:        strconv.Itoa(i + 1),
+			TotalMentions: total,
+			TotalTweets:   total,
+			Tweet:         []twitterTweet{{CreatedAt: recent}},
+		})
+	}
+
+	jsn, err := json.Marshal(map[string]interface{}{"dataquery": users})
+	if err != nil {
+		t.Fatalf("unable to marshal response: %v", err)
+	}
+	return jsn
+}
+
+func TestQueriesCheckOrder(t *testing.T) {
+	queries := []struct {
+		name  string
+		query interface{ runQuery(txn *dgo.Txn) error }
+	}{
+		{"queryThree", &queryThree{}},
+		{"queryFour", &queryFour{}},
+		{"queryEight", &queryEight{}},
+	}
+	responses := []struct {
+		name   string
+		totals []int64
+		err    error
+	}{
+		{"sorted", []int64{5, 3, 3, 1}, nil},
+		{"unsorted", []int64{5, 1, 3}, errInvalidResponse},
+	}
+
+	for _, q := range queries {
+		for _, r := range responses {
+			dgr := dgo.NewDgraphClient(&cannedDgraph{resp: userRows(t, r.totals...)})
+			if err := q.query.runQuery(dgr.NewReadOnlyTxn()); err != r.err {
+				t.Errorf("%s with %s response: expected %v, got %v", q.name, r.name, r.err, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cEpochLayout is the layout name that matches Unix timestamps, in seconds or in
+// milliseconds, told apart by their number of digits.
+const cEpochLayout = "epoch"
+
+// defaultLayouts are tried when no -created_at_layout is given, the format of the
+// twitter API comes first.
+var defaultLayouts = []string{cTimeFormat, time.RFC3339Nano, cEpochLayout}
+
+// createdAtLayouts parses the created_at of tweets with every layout in turn.
+var createdAtLayouts *layoutParser
+
+// layoutList is the ordered list of layouts set with repeated -created_at_layout flags.
+type layoutList []string
+
+func (l *layoutList) String() string {
+	return strings.Join(*l, " | ")
+}
+
+func (l *layoutList) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("expected a time layout or %v", cEpochLayout)
+	}
+
+	*l = append(*l, value)
+	return nil
+}
+
+// layoutParser parses times with the first of its layouts that matches, and counts how
+// many times each layout matched.
+type layoutParser struct {
+	layouts []string
+	matches []uint32
+}
+
+func newLayoutParser(layouts []string) *layoutParser {
+	if len(layouts) == 0 {
+		layouts = defaultLayouts
+	}
+
+	return &layoutParser{layouts: layouts, matches: make([]uint32, len(layouts))}
+}
+
+func (p *layoutParser) parse(value string) (time.Time, error) {
+	for i, layout := range p.layouts {
+		var t time.Time
+		var err error
+		if layout == cEpochLayout {
+			t, err = parseEpoch(value)
+		} else {
+			t, err = time.Parse(layout, value)
+		}
+
+		if err == nil {
+			atomic.AddUint32(&p.matches[i], 1)
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("created_at %q matches none of the layouts: %v",
+		value, strings.Join(p.layouts, " | "))
+}
+
+// parseEpoch parses Unix timestamps, those of more than 11 digits are in milliseconds.
+func parseEpoch(value string) (time.Time, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("not a Unix timestamp: %q", value)
+	}
+
+	if len(value) > 11 {
+		return time.Unix(0, n*int64(time.Millisecond)).UTC(), nil
+	}
+	return time.Unix(n, 0).UTC(), nil
+}
+
+// report prints how many times each layout matched, when more than one was tried.
+func (p *layoutParser) report() {
+	if p == nil || len(p.layouts) <= 1 {
+		return
+	}
+
+	var sb strings.Builder
+	for i, layout := range p.layouts {
+		fmt.Fprintf(&sb, "%q: %d, ", layout, atomic.LoadUint32(&p.matches[i]))
+	}
+	log.Printf("CREATED_AT layout matches %s\n", strings.TrimSuffix(sb.String(), ", "))
+}
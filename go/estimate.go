@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	// cHLLPrecision is the number of hash bits used to pick a register, the standard
+	// error of the estimate is 1.04/sqrt(2^precision), about 0.8% for 14 bits.
+	cHLLPrecision = 14
+	cHLLRegisters = 1 << cHLLPrecision
+)
+
+var estimator cardinalityEstimator
+
+// hyperLogLog estimates the number of distinct items added to it in constant space.
+type hyperLogLog struct {
+	registers [cHLLRegisters]uint8
+}
+
+func (h *hyperLogLog) add(item string) {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(item))
+	x := mix64(hasher.Sum64())
+
+	idx := x >> (64 - cHLLPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<cHLLPrecision|1<<(cHLLPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	const m = float64(cHLLRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		est = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(est + 0.5)
+}
+
+// mix64 is the finalizer of murmur3, it spreads the bits of FNV hashes of similar ids.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// cardinalityEstimator tracks the distinct users and tweets seen in the stream.
+type cardinalityEstimator struct {
+	sync.Mutex
+	users  hyperLogLog
+	tweets hyperLogLog
+}
+
+func (e *cardinalityEstimator) addTweet(tweet *twitterTweet) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.tweets.add(tweet.IDStr)
+	e.users.add(tweet.Author.UserID)
+	for _, user := range tweet.Mention {
+		e.users.add(user.UserID)
+	}
+}
+
+func (e *cardinalityEstimator) estimates() (users, tweets uint64) {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.users.estimate(), e.tweets.estimate()
+}
+
+// runEstimator parses tweets and adds them to the estimator without storing them.
+func runEstimator(c *y.Closer, tweets <-chan interface{}, work *interface{}) {
+	if tweets == nil {
+		return
+	}
+
+	for {
+		ingestion.wait(c)
+
+		select {
+		case <-c.HasBeenClosed():
+			return
+
+		case jsn, more := <-tweets:
+			if !more {
+				return
+			}
+
+			*work = jsn
+			atomic.AddUint32(&stats.Tweets, 1)
+
+			ft, err := filterTweet(jsn)
+			if err == errFiltered {
+				continue
+			}
+			if err != nil {
+				atomic.AddUint32(&stats.ErrorsJSON, 1)
+				continue
+			}
+
+			estimator.addTweet(ft)
+		}
+	}
+}
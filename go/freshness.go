@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/dgraph-io/dgo/v2/protos/api"
+)
+
+const (
+	// Bounds of the interval at which a probe tweet is queried until it is readable. The
+	// interval doubles after every query, so that polling doesn't load the alpha whose lag
+	// is measured. The lag is measured within an interval, finer for the shorter lags.
+	cMinFreshnessPoll = 10 * time.Millisecond
+	cMaxFreshnessPoll = time.Second
+	// cFreshnessTimeout is how long a probe tweet is queried for before giving up on it.
+	cFreshnessTimeout = 30 * time.Second
+)
+
+// runFreshnessCheck commits synthetic tweets one at a time, and measures how long it
+// takes for each of them to be readable. Reads are best effort, on a randomly picked
+// alpha of the first cluster, so that they observe the state the alpha has applied.
+func runFreshnessCheck(probes int) {
+	cluster := opts.Clusters[0]
+	alphas := newAPIClients(cluster.Addrs)
+	alterSchema(dgo.NewDgraphClient(alphas...))
+	pool := newAlphaPool(cluster.Name, cluster.Addrs, alphas)
+
+	infof("Checking freshness with %v probe tweets on %v alphas\n", probes, len(cluster.Addrs))
+
+	s := newSynthesizer(opts.SynthUsers)
+	var lags []time.Duration
+	timeouts := 0
+	for i := 0; i < probes; i++ {
+		u := newUpsert(s.tweet())
+		if u == nil {
+			continue
+		}
+
+		_, err := pool.pick().dgr.NewTxn().Do(context.Background(), &api.Request{
+			Query:     u.query,
+			Vars:      u.vars,
+			Mutations: u.mutations(),
+			CommitNow: true,
+		})
+		if err != nil {
+			warnf("Unable to commit probe tweet: %v\n", err)
+			continue
+		}
+		committed := time.Now()
+
+		reader := pool.pick()
+		poll := cMinFreshnessPoll
+		for {
+			readable, err := tweetReadable(reader.dgr, u.tweet.IDStr)
+			if err != nil {
+				warnf("Unable to query probe tweet: %v\n", err)
+			}
+			if readable {
+				lags = append(lags, time.Since(committed))
+				break
+			}
+			if time.Since(committed) > cFreshnessTimeout {
+				timeouts++
+				warnf("Probe tweet %v not readable on %v after %v\n",
+					u.tweet.IDStr, reader.addr, cFreshnessTimeout)
+				break
+			}
+
+			time.Sleep(poll)
+			if poll *= 2; poll > cMaxFreshnessPoll {
+				poll = cMaxFreshnessPoll
+			}
+		}
+	}
+
+	reportFreshness(lags, timeouts)
+}
+
+func tweetReadable(dgr *dgo.Dgraph, idStr string) (bool, error) {
+	q := fmt.Sprintf(`query q($t: string) { t(func: eq(%s, $t)) { uid } }`, opts.Mapping.TweetKey)
+	resp, err := dgr.NewReadOnlyTxn().BestEffort().QueryWithVars(context.Background(), q,
+		map[string]string{"$t": idStr})
+	if err != nil {
+		return false, err
+	}
+
+	var r struct {
+		T []struct {
+			UID string `json:"uid"`
+		} `json:"t"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		return false, err
+	}
+
+	return len(r.T) > 0, nil
+}
+
+// reportFreshness prints the distribution of the write to readable lag.
+func reportFreshness(lags []time.Duration, timeouts int) {
+	fmt.Printf("Freshness of %d probes, %d timed out\n", len(lags)+timeouts, timeouts)
+	if len(lags) == 0 {
+		return
+	}
+
+	sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+	var sum time.Duration
+	for _, lag := range lags {
+		sum += lag
+	}
+	percentile := func(p int) time.Duration {
+		return lags[(len(lags)-1)*p/100]
+	}
+
+	fmt.Printf("  min lag:  %v\n", lags[0].Round(time.Microsecond))
+	fmt.Printf("  avg lag:  %v\n", (sum / time.Duration(len(lags))).Round(time.Microsecond))
+	fmt.Printf("  p50 lag:  %v\n", percentile(50).Round(time.Microsecond))
+	fmt.Printf("  p90 lag:  %v\n", percentile(90).Round(time.Microsecond))
+	fmt.Printf("  p99 lag:  %v\n", percentile(99).Round(time.Microsecond))
+	fmt.Printf("  max lag:  %v\n", lags[len(lags)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// logLevel gates the log messages that are printed, it is set with -v. The periodic
+// stats and the summaries are the output of flock and are printed at every level.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+var verbosity = levelInfo
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func (l *logLevel) Set(value string) error {
+	for i, name := range logLevelNames {
+		if value == name {
+			*l = logLevel(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("expected one of %v, got %q", logLevelNames, value)
+}
+
+func logAt(level logLevel, format string, args ...interface{}) {
+	if level > verbosity {
+		return
+	}
+
+	switch level {
+	case levelError:
+		format = "ERROR " + format
+	case levelWarn:
+		format = "WARN " + format
+	case levelDebug:
+		format = "DEBUG " + format
+	}
+	log.Printf(format, args...)
+}
+
+func errorf(format string, args ...interface{}) { logAt(levelError, format, args...) }
+func warnf(format string, args ...interface{})  { logAt(levelWarn, format, args...) }
+func infof(format string, args ...interface{})  { logAt(levelInfo, format, args...) }
+func debugf(format string, args ...interface{}) { logAt(levelDebug, format, args...) }
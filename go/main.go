@@ -18,80 +18,95 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	crand "crypto/rand"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ChimeraCoder/anaconda"
 	"github.com/dgraph-io/badger/y"
 	"github.com/dgraph-io/dgo/v2"
 	"github.com/dgraph-io/dgo/v2/protos/api"
+	jsoniter "github.com/json-iterator/go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	cTimeFormat       = "Mon Jan 02 15:04:05 -0700 2006"
 	cDgraphTimeFormat = "2006-01-02T15:04:05.999999999-07:00"
 
-	cDgraphSchema = `
-		type Tweet {
-			id_str
-			created_at
-			message
-			urls
-			hashtags
-			author
-			mention
-			retweet
-		}
-		
-		type User {
-			user_id
-			user_name
-			screen_name
-			description
-			friends_count
-			followers_count
-			verified
-			profile_banner_url
-			profile_image_url
-		}
-
-		user_id: string @index(exact) @upsert .
-		user_name: string @index(hash) .
-		screen_name: string @index(term) .
-		description: string .
-		friends_count: int .
-		followers_count: int .
-		verified: bool .
-		profile_banner_url: string .
-		profile_image_url: string .
-		id_str: string @index(exact) @upsert .
-		created_at: dateTime @index(hour) .
-		message: string .
-		urls: [string] .
-		hashtags: [string] @index(exact) .
-		author: uid @count @reverse .
-		mention: [uid] @reverse .
-		retweet: bool .
-	`
+	// cMaxSampleLineLen is the length at which sampled lines with JSON errors are truncated.
+	cMaxSampleLineLen = 256
+
+	// Bounds of the delay applied before every transaction while the cluster is overloaded.
+	cMinBackoff = 10 * time.Millisecond
+	cMaxBackoff = 5 * time.Second
+
+	// cMaxOverloadRetries is the number of times an upsert is retried while the cluster is
+	// overloaded, before it is given up on.
+	cMaxOverloadRetries = 10
+
+	// cMaxAlterBackoff caps the delay between schema alterations with -alter_forever.
+	cMaxAlterBackoff = time.Minute
+
+	// Bounds of the delay before a worker that panicked is restarted.
+	cMinRestartDelay = 100 * time.Millisecond
+	cMaxRestartDelay = 10 * time.Second
 )
 
 var (
-	opts  progOptions
-	stats progStats
+	opts       progOptions
+	stats      progStats
+	jsonErrors jsonErrorSampler
+	numUpserts uint32
+	ingestion  pauseGate
+	liveSchema schemaReloader
+	overload   adaptiveBackoff
+
+	// The channels between the pipeline stages, observed to report the pipeline depth.
+	tweetChannel  chan interface{}
+	upsertChannel chan *upsert
+
+	// clusterPools has a pool per cluster the tweets are written to.
+	clusterPools []*alphaPool
+
+	// deadLetters is nil unless -dead_letter is set.
+	deadLetters *deadLetterWriter
+
+	// jsonMarshal encodes the mutations sent to Dgraph, it is selected with -json_encoder
+	// among jsonEncoders.
+	jsonMarshal  = json.Marshal
+	jsonEncoders = map[string]func(v interface{}) ([]byte, error){
+		"std":      json.Marshal,
+		"jsoniter": jsoniter.ConfigCompatibleWithStandardLibrary.Marshal,
+	}
 
 	errNotATweet      = errors.New("message in the stream is not a tweet")
+	errFiltered       = errors.New("tweet is filtered out")
 	errShouldNotReach = errors.New("invariant failed to satisfy")
 )
 
@@ -104,21 +119,148 @@ type twitterCreds struct {
 
 type progOptions struct {
 	NumClients       int
+	NumCommitters    int
 	CredentialsFile  string
 	DataFilesPath    string
 	ReportPeriodSecs int
 	NoCommitRatio    float64
 	AlphaSockAddr    []string
+	Clusters         []alphaCluster
+	PprofAddr        string
+	TwitterDelay     time.Duration
+	TwitterBuffer    int64
+	TwitterRateError bool
+	InsertOnly       bool
+	JSONErrorSamples int
+	DebugQueryEvery  uint32
+	MaxConnFailures  int
+	ProbeInterval    time.Duration
+	CountFacets      bool
+	JSONEncoder      string
+	Estimate         bool
+	Schema           string
+	Predicates       []predicateSchema
+	WaitConnect      time.Duration
+	GrpcCompressor   string
+	FileSampleRate   float64
+	Seed             int64
+	MaxFailureRate   float64
+	WebhookURL       string
+	Source           string
+	MastodonURL      string
+	MastodonToken    string
+	ChanSize         int
+	DeadLetterPath   string
+	Mapping          dataMapping
+	Benchmark        bool
+	Duration         time.Duration
+	Warmup           time.Duration
+	RunFor           time.Duration
+	SourceTag        string
+	TopMentions      int
+	MutationsPerTxn  int
+	BatchDeadline    time.Duration
+	SchemaAlpha      string
+	HashtagNodes     bool
+	VerifySampleRate float64
+	StartJitter      time.Duration
+	StoreZeroValues  bool
+	SynthRate        float64
+	SynthUsers       int
+	EpochTimestamp   bool
+	AlterForever     bool
+	ConnsPerAlpha    int
+	RunID            string
+	StoreRunID       bool
+	ProfilePolicy    string
+	StatsCSVPath     string
+	OnlyLang         string
+	SkipMentionNodes bool
+	FreshnessProbes  int
+	ReadWorkers      int
+	MinFollowers     int
+	StoreEngagement  bool
+	LiveSchemaPath   string
+	FailOnErrors     bool
+	FailThreshold    float64
+	HashtagFilter    *regexp.Regexp
+	DropUntagged     bool
+	BlindInsert      bool
+	StatsdAddr       string
+	CheckSchema      bool
+	IdleTimeout      time.Duration
+	EntityIndices    bool
+	FailFast         bool
+	StoreReplies     bool
+	StoreSensitive   bool
+	StoreWithheld    bool
+	FilteredStreams  []filteredStream
+	BulkExportDir    string
 }
 
 type progStats struct {
-	Tweets        uint32
-	Commits       uint32
-	LeakedCommits uint32
-	Retries       uint32
-	Failures      uint32
-	ErrorsJSON    uint32
-	ErrorsDgraph  uint32
+	Tweets          uint32
+	Commits         uint32
+	LeakedCommits   uint32
+	Retries         uint32
+	Skipped         uint32
+	Failures        uint32
+	ErrorsJSON      uint32
+	ErrorsDgraph    uint32
+	EmptyMessages   uint32
+	Deletes         uint32
+	VerifyFailures  uint32
+	Overloaded      uint32
+	LangSkipped     uint32
+	SmallAuthors    uint32
+	Untagged        uint32
+	Panics          uint32
+	SizeCommits     uint32
+	DeadlineCommits uint32
+}
+
+type jsonErrorSample struct {
+	Source string
+	Line   string
+	Err    string
+}
+
+// jsonErrorSampler keeps the first few lines of the input that failed to unmarshal.
+type jsonErrorSampler struct {
+	sync.Mutex
+	samples []jsonErrorSample
+}
+
+func (s *jsonErrorSampler) record(source string, line []byte, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.samples) >= opts.JSONErrorSamples {
+		return
+	}
+
+	if len(line) > cMaxSampleLineLen {
+		line = append(line[:cMaxSampleLineLen:cMaxSampleLineLen], "..."...)
+	}
+	s.samples = append(s.samples, jsonErrorSample{
+		Source: source,
+		Line:   string(line),
+		Err:    err.Error(),
+	})
+}
+
+func (s *jsonErrorSampler) report() {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.samples) == 0 {
+		return
+	}
+
+	log.Printf("Sampled %d of %d JSON errors\n", len(s.samples), atomic.LoadUint32(&stats.ErrorsJSON))
+	for _, sample := range s.samples {
+		log.Printf("JSON_ERR %s :: %s :: %s\n", sample.Source, sample.Err, sample.Line)
+	}
 }
 
 type twitterUser struct {
@@ -128,11 +270,19 @@ type twitterUser struct {
 	UserName         string `json:"user_name,omitempty"`
 	ScreenName       string `json:"screen_name,omitempty"`
 	Description      string `json:"description,omitempty"`
-	FriendsCount     int    `json:"friends_count,omitempty"`
-	FollowersCount   int    `json:"followers_count,omitempty"`
-	Verified         bool   `json:"verified,omitempty"`
+	FriendsCount     *int   `json:"friends_count,omitempty"`
+	FollowersCount   *int   `json:"followers_count,omitempty"`
+	Verified         *bool  `json:"verified,omitempty"`
 	ProfileBannerURL string `json:"profile_banner_url,omitempty"`
 	ProfileImageURL  string `json:"profile_image_url,omitempty"`
+	SourceTag        string `json:"source_tag,omitempty"`
+
+	// ProfileAt is the observation time of the profile, set unless -profile_policy is always.
+	ProfileAt string `json:"profile_at,omitempty"`
+
+	// Observation time of the counts, stored as facets on the count predicates.
+	FriendsCountAt   string `json:"friends_count|observed_at,omitempty"`
+	FollowersCountAt string `json:"followers_count|observed_at,omitempty"`
 }
 
 type twitterTweet struct {
@@ -146,383 +296,2753 @@ type twitterTweet struct {
 	Author     twitterUser   `json:"author"`
 	Mention    []twitterUser `json:"mention,omitempty"`
 	Retweet    bool          `json:"retweet"`
+	SourceTag  string        `json:"source_tag,omitempty"`
+
+	// Tagged links the tweet to a node per distinct hashtag, set with -hashtag_nodes.
+	Tagged []twitterHashtag `json:"tagged,omitempty"`
+
+	// The tweet and user replied to, the tweet is created as a stub if it wasn't seen.
+	ReplyTo     *twitterTweetRef `json:"reply_to,omitempty"`
+	ReplyToUser *twitterUser     `json:"reply_to_user,omitempty"`
+
+	// CreatedAtEpoch is the Unix time of created_at, set with -epoch_timestamp.
+	CreatedAtEpoch int64 `json:"created_at_epoch,omitempty"`
+
+	// RunID is the run that stored the tweet, set with -store_run_id.
+	RunID string `json:"run_id,omitempty"`
+
+	// MentionNames replaces the mention edges with -skip_mention_nodes.
+	MentionNames []string `json:"mention_names,omitempty"`
+
+	// The engagement of the tweet when it was seen, set with -store_engagement.
+	RetweetCount  *int `json:"retweet_count,omitempty"`
+	FavoriteCount *int `json:"favorite_count,omitempty"`
+
+	PossiblySensitive *bool `json:"possibly_sensitive,omitempty"`
+
+	// The countries the tweet is withheld in, and whether the tweet or its author is.
+	WithheldCountries []string `json:"withheld_countries,omitempty"`
+	WithheldScope     string   `json:"withheld_scope,omitempty"`
+
+	// Entities holds the offsets of the entities in the message as a JSON array of
+	// entitySpan, set with -entity_indices.
+	Entities string `json:"entities,omitempty"`
+}
+
+// entitySpan is an entity of a tweet, at the [Start, End) character offsets of its message.
+type entitySpan struct {
+	Type  string `json:"type"`
+	Text  string `json:"text"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// twitterTweetRef refers to a tweet by its id only.
+type twitterTweetRef struct {
+	UID        string `json:"uid,omitempty"`
+	DgraphType string `json:"dgraph.type,omitempty"`
+	IDStr      string `json:"id_str,omitempty"`
+}
+
+type twitterHashtag struct {
+	UID        string `json:"uid,omitempty"`
+	DgraphType string `json:"dgraph.type,omitempty"`
+	Tag        string `json:"tag,omitempty"`
 }
 
-func buildQuery(tweet *twitterTweet) string {
-	tweetQuery := `t as var(func: eq(id_str, "%s"))`
-	userQuery := `%s as var(func: eq(user_id, "%s"))`
+// buildQuery returns the query of the upsert of the tweet, along with its variables.
+// The ids and tags come from the stream, they are passed as variables rather than
+// written into the query, so that no value can break it.
+func buildQuery(tweet *twitterTweet) (string, map[string]string) {
+	vars := make(map[string]string)
+	bind := func(name, value string) string {
+		vars["$"+name] = value
+		return "$" + name
+	}
+
+	tweetQuery := func(varName, idStr string) string {
+		return fmt.Sprintf(`%s as var(func: eq(%s, %s))`, varName, opts.Mapping.TweetKey,
+			bind(varName, idStr))
+	}
+	userQuery := func(varName, userID string) string {
+		return fmt.Sprintf(`%s as var(func: eq(%s, %s))`, varName, opts.Mapping.UserKey,
+			bind(varName, userID))
+	}
 
-	query := make([]string, len(tweet.Mention)+2)
+	query := make([]string, 0, len(tweet.Mention)+2)
 
-	query[0] = fmt.Sprintf(tweetQuery, tweet.IDStr)
+	query = append(query, tweetQuery("t", tweet.IDStr))
 	tweet.UID = "uid(t)"
 
-	query[1] = fmt.Sprintf(userQuery, "u", tweet.Author.UserID)
+	query = append(query, userQuery("u", tweet.Author.UserID))
 	tweet.Author.UID = "uid(u)"
 
 	usersMap := make(map[string]string)
 	usersMap[tweet.Author.UserID] = "u"
 
+	// A user can be observed more than once in a tweet, as the author and in mentions.
+	// All the observations are merged into the first one, the others only refer to the
+	// user, so that the mutation doesn't carry conflicting partial profiles. The author
+	// comes first, its profile takes precedence over the partial ones of mentions.
+	users := make(map[string]*twitterUser)
+	users[tweet.Author.UserID] = &tweet.Author
+
 	// We will query only once for every user. We are storing all the users in the map who
 	// we have already queried. If a user_id is repeated, we will just use uid that we got
-	// in the previous query.
-	for i, user := range tweet.Mention {
-		var varName string
-		if name, ok := usersMap[user.UserID]; ok {
-			varName = name
-		} else {
-			varName = fmt.Sprintf("m%d", i+1)
-			query[i+2] = fmt.Sprintf("%s as var(func: eq(user_id, %s))", varName, user.UserID)
+	// in the previous query. Variable names are numbered from m0 by the count of distinct
+	// users other than the author seen so far, so they stay unique and contiguous even when
+	// mentions are repeated.
+	mentions := tweet.Mention[:0]
+	mentioned := make(map[string]bool)
+	for _, user := range tweet.Mention {
+		first, seen := users[user.UserID]
+		if seen {
+			mergeUser(first, user)
+		}
+		if mentioned[user.UserID] {
+			continue
+		}
+		mentioned[user.UserID] = true
+
+		varName, ok := usersMap[user.UserID]
+		if !ok {
+			varName = fmt.Sprintf("m%d", len(usersMap)-1)
+			query = append(query, userQuery(varName, user.UserID))
 			usersMap[user.UserID] = varName
 		}
 
-		tweet.Mention[i].UID = fmt.Sprintf("uid(%s)", varName)
+		user.UID = fmt.Sprintf("uid(%s)", varName)
+		if seen {
+			user = userRef(user)
+		}
+		mentions = append(mentions, user)
+		if !seen {
+			// mentions shares the array of tweet.Mention and is never reallocated
+			users[user.UserID] = &mentions[len(mentions)-1]
+		}
 	}
+	tweet.Mention = mentions
 
-	finalQuery := fmt.Sprintf("query {%s}", strings.Join(query, "\n"))
-	return finalQuery
-}
+	if tweet.ReplyTo != nil {
+		query = append(query, tweetQuery("r", tweet.ReplyTo.IDStr))
+		tweet.ReplyTo.UID = "uid(r)"
+	}
+	if tweet.ReplyToUser != nil {
+		varName, ok := usersMap[tweet.ReplyToUser.UserID]
+		if !ok {
+			varName = fmt.Sprintf("m%d", len(usersMap)-1)
+			query = append(query, userQuery(varName, tweet.ReplyToUser.UserID))
+			usersMap[tweet.ReplyToUser.UserID] = varName
+		}
+		tweet.ReplyToUser.UID = fmt.Sprintf("uid(%s)", varName)
+		if first, ok := users[tweet.ReplyToUser.UserID]; ok {
+			mergeUser(first, *tweet.ReplyToUser)
+			ref := userRef(*tweet.ReplyToUser)
+			tweet.ReplyToUser = &ref
+		}
+	}
 
-func runInserter(alphas []api.DgraphClient, c *y.Closer, tweets <-chan interface{}) {
-	defer c.Done()
+	// Unless profiles are always overwritten, they are set by separate mutations that
+	// are conditional on these blocks being empty, see splitProfiles. The author's
+	// profile is kept if it was set before, or by a newer tweet with the newest policy.
+	// Mentions and replies carry partial profiles that never overwrite a profile.
+	if opts.ProfilePolicy != "always" {
+		authorFilter := "has(profile_at)"
+		if opts.ProfilePolicy == "newest" {
+			authorFilter = fmt.Sprintf(`ge(profile_at, %s)`, bind("created_at", tweet.CreatedAt))
+		}
+		query = append(query, fmt.Sprintf(`pu as var(func: uid(u)) @filter(%s)`, authorFilter))
 
-	if tweets == nil {
-		return
+		varNames := make([]string, 0, len(usersMap))
+		for _, varName := range usersMap {
+			if varName != "u" {
+				varNames = append(varNames, varName)
+			}
+		}
+		sort.Strings(varNames)
+		for _, varName := range varNames {
+			query = append(query, fmt.Sprintf(
+				`p%[1]s as var(func: uid(%[1]s)) @filter(has(profile_at))`, varName))
+		}
 	}
 
-	dgr := dgo.NewDgraphClient(alphas...)
-	for {
-		select {
-		case <-c.HasBeenClosed():
-			return
+	// Hashtag nodes are upserted the same way as users, keyed on the tag.
+	for i, hashtag := range tweet.Tagged {
+		varName := fmt.Sprintf("h%d", i)
+		query = append(query, fmt.Sprintf(`%s as var(func: eq(tag, %s))`, varName,
+			bind(fmt.Sprintf("tag%d", i), hashtag.Tag)))
+		tweet.Tagged[i].UID = fmt.Sprintf("uid(%s)", varName)
+	}
 
-		case jsn, more := <-tweets:
-			if !more {
-				return
-			}
+	// In insert only mode, the mutation is conditional on the tweet not existing already.
+	// This block returns the existing tweet, if any, so that skips can be counted.
+	if opts.InsertOnly {
+		query = append(query, `existing(func: uid(t)) { uid }`)
+	}
 
-			atomic.AddUint32(&stats.Tweets, 1)
+	decls := make([]string, 0, len(vars))
+	for name := range vars {
+		decls = append(decls, name+": string")
+	}
+	sort.Strings(decls)
 
-			ft, err := filterTweet(jsn)
-			if err != nil {
-				atomic.AddUint32(&stats.ErrorsJSON, 1)
-				continue
-			}
+	finalQuery := fmt.Sprintf("query q(%s) {%s}", strings.Join(decls, ", "),
+		strings.Join(query, "\n"))
+	return finalQuery, vars
+}
 
-			// Now, we need query UIDs and ensure they don't already exists
-			txn := dgr.NewTxn()
-			// txn is not being discarded deliberately
-			// defer txn.Discard()
+// alphaConn is a connection to a single alpha along with its health.
+type alphaConn struct {
+	addr      string
+	dgr       *dgo.Dgraph
+	stats     *alphaStats
+	failures  int
+	dead      bool
+	nextProbe time.Time
+}
 
-			queryStr := buildQuery(ft)
+// alphaStats are the commit latencies and errors of an alpha, shared by all the
+// connections to its address, so that a slow alpha stands out of the blended stats.
+type alphaStats struct {
+	addr    string
+	latency latencyRecorder
+	errors  uint32
+}
 
-			tweet, err := json.Marshal(ft)
-			if err != nil {
-				atomic.AddUint32(&stats.ErrorsJSON, 1)
-				continue
-			}
+var (
+	alphaStatsLock sync.Mutex
+	alphaStatsList []*alphaStats
+)
 
-			commitNow := true
-			if rand.Float64() < opts.NoCommitRatio {
-				commitNow = false
-			}
+// statsOfAlpha returns the stats of the alpha at addr, creating them on first use.
+func statsOfAlpha(addr string) *alphaStats {
+	alphaStatsLock.Lock()
+	defer alphaStatsLock.Unlock()
 
-			// only ONE retry attempt is made
-			retry := true
-		RETRY:
-			apiUpsert := &api.Request{
-				Mutations: []*api.Mutation{
-					&api.Mutation{
-						SetJson: tweet,
-					},
-				},
-				CommitNow: commitNow,
-				Query:     queryStr,
-			}
-			_, err = txn.Do(context.Background(), apiUpsert)
-			switch {
-			case err == nil:
-				if commitNow {
-					atomic.AddUint32(&stats.Commits, 1)
-				} else {
-					atomic.AddUint32(&stats.LeakedCommits, 1)
-				}
-			case strings.Contains(err.Error(), "connection refused"):
-				// wait for alpha to (re)start
-				log.Printf("ERROR Connection refused... waiting a bit\n")
-				time.Sleep(5 * time.Second)
-			case strings.Contains(err.Error(), "already been committed or discarded"):
-				atomic.AddUint32(&stats.Failures, 1)
-			case retry && strings.Contains(err.Error(), "Please retry"):
-				atomic.AddUint32(&stats.Retries, 1)
-				time.Sleep(100 * time.Millisecond)
-				retry = false
-				goto RETRY
-			default:
-				atomic.AddUint32(&stats.ErrorsDgraph, 1)
-				log.Printf("ERROR Unable to commit: %v\n", err)
-			}
+	for _, s := range alphaStatsList {
+		if s.addr == addr {
+			return s
 		}
 	}
+	s := &alphaStats{addr: addr}
+	alphaStatsList = append(alphaStatsList, s)
+	return s
 }
 
-func filterTweet(jsn interface{}) (*twitterTweet, error) {
-	var tweet anaconda.Tweet
-	switch msg := jsn.(type) {
-	case anaconda.Tweet:
-		tweet = msg
-	default:
-		return nil, errNotATweet
-	}
-
-	createdAt, err := time.Parse(cTimeFormat, tweet.CreatedAt)
-	if err != nil {
-		return nil, err
-	}
+// alphaCluster is a named group of alphas making up a dgraph cluster.
+type alphaCluster struct {
+	Name  string
+	Addrs []string
+}
 
-	expandedURLs := make([]string, len(tweet.Entities.Urls))
-	for _, url := range tweet.Entities.Urls {
-		expandedURLs = append(expandedURLs, url.Expanded_url)
+// parseClusters parses the -a flag, either a comma separated list of alphas making up
+// a single cluster, or a semicolon separated list of name=alphas clusters to fan out to.
+func parseClusters(value string) ([]alphaCluster, error) {
+	if !strings.Contains(value, "=") {
+		return []alphaCluster{{Name: "default", Addrs: strings.Split(value, ",")}}, nil
 	}
 
-	hashTagTexts := make([]string, 0)
-	for _, tag := range tweet.Entities.Hashtags {
-		if tag.Text != "" {
-			hashTagTexts = append(hashTagTexts, tag.Text)
+	var clusters []alphaCluster
+	names := make(map[string]bool)
+	for _, group := range strings.Split(value, ";") {
+		parts := strings.SplitN(group, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || parts[1] == "" || names[name] {
+			return nil, fmt.Errorf("expected name=alphas[;name=alphas...], got %q", group)
 		}
-	}
+		names[name] = true
 
-	var userMentions []twitterUser
-	for _, userMention := range tweet.Entities.User_mentions {
-		userMentions = append(userMentions, twitterUser{
-			UserID:     userMention.Id_str,
-			DgraphType: "User",
-			UserName:   userMention.Name,
-			ScreenName: userMention.Screen_name,
-		})
+		clusters = append(clusters, alphaCluster{Name: name, Addrs: strings.Split(parts[1], ",")})
 	}
 
-	return &twitterTweet{
-		IDStr:      tweet.IdStr,
-		DgraphType: "Tweet",
-		CreatedAt:  createdAt.Format(cDgraphTimeFormat),
-		Message:    tweet.FullText,
-		URLs:       expandedURLs,
-		HashTags:   hashTagTexts,
-		Author: twitterUser{
-			UserID:           tweet.User.IdStr,
-			DgraphType:       "User",
-			UserName:         tweet.User.Name,
-			ScreenName:       tweet.User.ScreenName,
-			Description:      tweet.User.Description,
-			FriendsCount:     tweet.User.FriendsCount,
-			FollowersCount:   tweet.User.FollowersCount,
-			Verified:         tweet.User.Verified,
-			ProfileBannerURL: tweet.User.ProfileBannerURL,
-			ProfileImageURL:  tweet.User.ProfileImageURL,
-		},
-		Mention: userMentions,
-		Retweet: tweet.Retweeted,
-	}, nil
+	return clusters, nil
 }
 
-func readCredentials(path string) twitterCreds {
-	jsn, err := ioutil.ReadFile(path)
-	checkFatal(err, "Unable to open twitter credentials file '%s'", path)
+// alphaPool spreads transactions across the alphas of a cluster. An alpha is removed
+// from the rotation after consecutive connection failures and is probed again every
+// probe interval.
+type alphaPool struct {
+	sync.Mutex
+	name   string
+	alphas []*alphaConn
+
+	// commits and errors count the upserts committed to and failed on the cluster.
+	commits uint32
+	errors  uint32
+}
 
-	var creds twitterCreds
-	err = json.Unmarshal(jsn, &creds)
-	checkFatal(err, "Unable to parse twitter credentials file '%s'", path)
+func newAlphaPool(name string, sockAddr []string, clients []api.DgraphClient) *alphaPool {
+	p := &alphaPool{name: name}
+	for i, client := range clients {
+		p.alphas = append(p.alphas, &alphaConn{
+			addr:  sockAddr[i],
+			dgr:   dgo.NewDgraphClient(client),
+			stats: statsOfAlpha(sockAddr[i]),
+		})
+	}
 
-	return creds
+	return p
 }
 
-func newTwitterClient(creds twitterCreds) *anaconda.TwitterApi {
-	client := anaconda.NewTwitterApiWithCredentials(
-		creds.AccessToken, creds.AccessSecret,
-		creds.ConsumerKey, creds.ConsumerSecret,
-	)
+// pick returns a random healthy alpha. A dead alpha is returned instead when it is due
+// for a probe, and any alpha is returned if none of them are healthy.
+func (p *alphaPool) pick() *alphaConn {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	healthy := make([]*alphaConn, 0, len(p.alphas))
+	for _, a := range p.alphas {
+		if !a.dead {
+			healthy = append(healthy, a)
+			continue
+		}
 
-	ok, err := client.VerifyCredentials()
-	checkFatal(err, "error in verifying credentials")
-	if !ok {
-		checkFatal(errors.New("invalid credentials"), "twitter")
+		if now.After(a.nextProbe) {
+			a.nextProbe = now.Add(opts.ProbeInterval)
+			return a
+		}
 	}
 
-	return client
+	if len(healthy) == 0 {
+		return p.alphas[rand.Intn(len(p.alphas))]
+	}
+	return healthy[rand.Intn(len(healthy))]
 }
 
-func newAPIClients(sockAddr []string) []api.DgraphClient {
-	var clients []api.DgraphClient
+func (p *alphaPool) success(a *alphaConn) {
+	p.Lock()
+	defer p.Unlock()
 
-	for _, sa := range sockAddr {
-		conn, err := grpc.Dial(sa, grpc.WithInsecure())
-		checkFatal(err, "Unable to connect to dgraph")
-		clients = append(clients, api.NewDgraphClient(conn))
+	if a.dead {
+		infof("Alpha %v is reachable again, adding it back to rotation\n", a.addr)
 	}
-
-	return clients
+	a.failures = 0
+	a.dead = false
 }
 
-// TODO: fix the race condition here
-func reportStats(c *y.Closer) {
-	defer c.Done()
+// countErrors counts upserts that failed on the alpha, not necessarily because of the
+// connection.
+func (p *alphaPool) countErrors(a *alphaConn, n int) {
+	atomic.AddUint32(&p.errors, uint32(n))
+	atomic.AddUint32(&a.stats.errors, uint32(n))
+}
 
-	var oldStats, newStats progStats
-	log.Printf("Reporting stats every %v seconds\n", opts.ReportPeriodSecs)
-	for {
-		newStats = stats
-		log.Printf("STATS tweets: %d, commits: %d, leaked: %d, json_errs: %d, "+
-			"retries: %d, failures: %d, dgraph_errs: %d, "+
-			"commit_rate: %d/sec\n",
-			newStats.Tweets, newStats.Commits, newStats.LeakedCommits, newStats.ErrorsJSON,
-			newStats.Retries, newStats.Failures, newStats.ErrorsDgraph,
-			(newStats.Tweets-oldStats.Tweets)/uint32(opts.ReportPeriodSecs))
-		oldStats = newStats
+// failure records a connection failure and reports whether any healthy alpha is left.
+func (p *alphaPool) failure(a *alphaConn) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	a.failures++
+	if !a.dead && opts.MaxConnFailures > 0 && a.failures >= opts.MaxConnFailures {
+		errorf("Alpha %v failed %d times, removing it from rotation\n",
+			a.addr, a.failures)
+		a.dead = true
+		a.nextProbe = time.Now().Add(opts.ProbeInterval)
+	}
 
-		select {
-		case <-c.HasBeenClosed():
-			return
-		default:
-			time.Sleep(time.Second * time.Duration(opts.ReportPeriodSecs))
+	for _, other := range p.alphas {
+		if !other.dead {
+			return true
 		}
 	}
+	return false
 }
 
-func checkFatal(err error, format string, args ...interface{}) {
-	if err != nil {
-		msg := fmt.Sprintf(format, args...)
-		_, _ = fmt.Fprintf(os.Stderr, "%s :: %s\n", msg, err)
-		os.Exit(1)
+// mergeUser fills the fields missing from an observation of a user with another one.
+func mergeUser(into *twitterUser, from twitterUser) {
+	if into.UserName == "" {
+		into.UserName = from.UserName
 	}
-}
-
-func main() {
-	dgclients := flag.Int("l", 8, "number of dgraph clients to run")
-	credentialsFile := flag.String("c", "credentials.json", "path to credentials file")
-	dataFilesPath := flag.String("d", "", "path containing json files with tweets in each line")
-	noCommitRatio := flag.Float64("p", 0, "prob of CommitNow=False, from 0.0 to 1.0")
-	alphasAddress := flag.String("a", ":9180,:9182,:9183", "comma separated addresses to alphas")
-	flag.Parse()
-
-	if *noCommitRatio > 1 || *noCommitRatio < 0 {
-		log.Fatalf("invalid value for commit=false probability")
+	if into.ScreenName == "" {
+		into.ScreenName = from.ScreenName
 	}
-	opts = progOptions{
-		NumClients:       *dgclients,
-		CredentialsFile:  *credentialsFile,
-		DataFilesPath:    *dataFilesPath,
-		ReportPeriodSecs: 2,
-		NoCommitRatio:    *noCommitRatio,
-		AlphaSockAddr:    strings.Split(*alphasAddress, ","),
+	if into.Description == "" {
+		into.Description = from.Description
 	}
-
-	alphas := newAPIClients(opts.AlphaSockAddr)
-
-	// setup schema
-	dgr := dgo.NewDgraphClient(alphas...)
-	op := &api.Operation{
-		Schema: cDgraphSchema,
+	if into.FriendsCount == nil {
+		into.FriendsCount = from.FriendsCount
 	}
-	retryCount := 0
-	for {
-		err := dgr.Alter(context.Background(), op)
-		if err == nil {
-			break
-		}
-
-		retryCount++
-		if retryCount == 3 {
-			checkFatal(err, "error in creating indexes")
-		}
+	if into.FollowersCount == nil {
+		into.FollowersCount = from.FollowersCount
+	}
+	if into.Verified == nil {
+		into.Verified = from.Verified
+	}
+	if into.ProfileBannerURL == "" {
+		into.ProfileBannerURL = from.ProfileBannerURL
+	}
+	if into.ProfileImageURL == "" {
+		into.ProfileImageURL = from.ProfileImageURL
+	}
+}
 
-		log.Println("sleeping for 1 sec, alter failed")
-		time.Sleep(1 * time.Second)
+// userRef returns what refers to a user without setting any of its profile.
+func userRef(user twitterUser) twitterUser {
+	return twitterUser{
+		UID:        user.UID,
+		DgraphType: user.DgraphType,
+		UserID:     user.UserID,
+		SourceTag:  user.SourceTag,
 	}
+}
 
-	// report stats
-	r := y.NewCloser(1)
-	go reportStats(r)
-	log.Printf("Using %v dgraph clients on %v alphas\n",
-		opts.NumClients, len(opts.AlphaSockAddr))
+// pauseGate holds back the consumers of the tweet channel while ingestion is paused.
+// It is toggled with SIGUSR1.
+type pauseGate struct {
+	sync.Mutex
+	resume chan struct{}
+}
 
-	var tweetChannel chan interface{}
-	if opts.DataFilesPath == "" {
-		creds := readCredentials(opts.CredentialsFile)
-		client := newTwitterClient(creds)
-		stream := client.PublicStreamSample(nil)
-		tweetChannel = stream.C
-		defer stream.Stop()
-	} else {
-		tweetChannel = setupChannelFromDir(opts.DataFilesPath)
-	}
+// toggle pauses ingestion if it is running and resumes it otherwise, and reports
+// whether it is now paused.
+func (g *pauseGate) toggle() bool {
+	g.Lock()
+	defer g.Unlock()
 
-	// read twitter stream
-	c := y.NewCloser(0)
-	for i := 0; i < opts.NumClients; i++ {
-		c.AddRunning(1)
-		go runInserter(alphas, c, tweetChannel)
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+		return false
 	}
 
-	c.Wait()
-	r.SignalAndWait()
-	log.Println("Stopping stream...")
+	g.resume = make(chan struct{})
+	return true
 }
 
-func setupChannelFromDir(dataPath string) chan interface{} {
-	info, err := os.Stat(dataPath)
-	checkFatal(err, "error in opening path to json files")
+func (g *pauseGate) paused() bool {
+	g.Lock()
+	defer g.Unlock()
 
-	var files []string
-	switch {
-	case info.IsDir():
-		// handle directory case
-		err := filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	return g.resume != nil
+}
 
-			if info.IsDir() {
-				return nil
-			}
+// wait blocks while ingestion is paused, or until c is closed.
+func (g *pauseGate) wait(c *y.Closer) {
+	g.Lock()
+	resume := g.resume
+	g.Unlock()
 
-			files = append(files, path)
-			return nil
-		})
+	if resume == nil {
+		return
+	}
 
-		checkFatal(err, "error in walking input data directory")
-	default:
-		// handle single file
-		files = append(files, dataPath)
+	select {
+	case <-resume:
+	case <-c.HasBeenClosed():
 	}
+}
 
-	dataChan := make(chan interface{})
-	go func() {
-		for _, dataFile := range files {
-			log.Println("reading file:", dataFile)
+func handlePause() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
 
-			fd, err := os.Open(dataFile)
-			if err != nil {
-				checkFatal(err, "error in opening file: %v", dataFile)
-			}
+	for range sigs {
+		if ingestion.toggle() {
+			infof("Received SIGUSR1, pausing ingestion\n")
+		} else {
+			infof("Received SIGUSR1, resuming ingestion\n")
+		}
+	}
+}
 
-			scanner := bufio.NewScanner(fd)
-			for scanner.Scan() {
-				var t anaconda.Tweet
-				if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
-					atomic.AddUint32(&stats.ErrorsJSON, 1)
-					continue
-				}
+// schemaReloader lets the schema be altered on SIGHUP without restarting. Committers
+// hold it for reading while they have a transaction in flight, the reload holds it for
+// writing, so that the schema is only altered once all the transactions are drained.
+type schemaReloader struct {
+	sync.RWMutex
+	dgrs []*dgo.Dgraph
 
-				dataChan <- t
-			}
+	m    sync.Mutex
+	next *schemaReload
+}
 
-			checkFatal(scanner.Err(), "error in scanning file: %v", dataFile)
-			fd.Close()
-		}
+// schemaReload is a single reload, committers flush their open transactions once drain
+// is closed, and wait for done to be closed before starting new ones.
+type schemaReload struct {
+	drain chan struct{}
+	done  chan struct{}
+}
 
-		close(dataChan)
-	}()
+func newSchemaReload() *schemaReload {
+	return &schemaReload{drain: make(chan struct{}), done: make(chan struct{})}
+}
 
-	return dataChan
+// upcoming returns the next reload, that committers are notified of.
+func (r *schemaReloader) upcoming() *schemaReload {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.next == nil {
+		r.next = newSchemaReload()
+	}
+	return r.next
+}
+
+// reload drains the transactions in flight, and alters the schema of every cluster with
+// the one in path. Failures are logged, the previous schema stays in place.
+func (r *schemaReloader) reload(path string) {
+	schema, err := ioutil.ReadFile(path)
+	if err != nil {
+		errorf("Unable to read schema to reload: %v\n", err)
+		return
+	}
+
+	// the reload stays the upcoming one until it is done, so that committers looking for
+	// it in the meantime are drained too
+	reload := r.upcoming()
+	close(reload.drain)
+	r.Lock()
+	infof("Drained transactions in flight, altering schema\n")
+	for _, dgr := range r.dgrs {
+		if err := dgr.Alter(context.Background(), &api.Operation{Schema: string(schema)}); err != nil {
+			errorf("Unable to reload schema: %v\n", err)
+		}
+	}
+	r.Unlock()
+
+	r.m.Lock()
+	r.next = nil
+	r.m.Unlock()
+	close(reload.done)
+}
+
+func handleSchemaReload(path string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		infof("Received SIGHUP, reloading schema from %v\n", path)
+		liveSchema.reload(path)
+		infof("Schema reloaded, resuming ingestion\n")
+	}
+}
+
+// adaptiveBackoff slows down all the committers while the cluster reports that it is
+// overloaded. The delay doubles on every overload error and halves on every success.
+type adaptiveBackoff struct {
+	sync.Mutex
+	delay time.Duration
+}
+
+func (b *adaptiveBackoff) wait() {
+	b.Lock()
+	delay := b.delay
+	b.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (b *adaptiveBackoff) overloaded() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.delay *= 2
+	if b.delay < cMinBackoff {
+		b.delay = cMinBackoff
+	}
+	if b.delay > cMaxBackoff {
+		b.delay = cMaxBackoff
+	}
+}
+
+func (b *adaptiveBackoff) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.delay /= 2
+	if b.delay < cMinBackoff {
+		b.delay = 0
+	}
+}
+
+func (b *adaptiveBackoff) current() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.delay
+}
+
+// isOverloaded reports whether the error is gRPC's way of telling that the cluster
+// can't keep up with the load.
+func isOverloaded(err error) bool {
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// upsert is a parsed tweet, or a deletion notice, ready to be committed to dgraph.
+type upsert struct {
+	tweet    *twitterTweet
+	query    string
+	vars     map[string]string
+	mutation *api.Mutation
+	profiles []*api.Mutation
+	deletion bool
+}
+
+func (u *upsert) mutations() []*api.Mutation {
+	return append([]*api.Mutation{u.mutation}, u.profiles...)
+}
+
+// supervise runs the worker until it returns, restarting it whenever it panics so that
+// a single bad tweet doesn't end the whole run. The worker keeps what it is processing
+// in work, to be logged along with the panic. The delay before a restart doubles while
+// the worker keeps panicking, so that a panic on every run doesn't spin the CPU.
+func supervise(c *y.Closer, name string, worker func(work *interface{})) {
+	defer c.Done()
+
+	delay := cMinRestartDelay
+	for {
+		start := time.Now()
+		if runWorker(name, worker) {
+			return
+		}
+
+		// a worker that ran for a while before panicking starts over from the minimum
+		if time.Since(start) > cMaxRestartDelay {
+			delay = cMinRestartDelay
+		}
+		select {
+		case <-c.HasBeenClosed():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > cMaxRestartDelay {
+			delay = cMaxRestartDelay
+		}
+	}
+}
+
+// runWorker runs the worker once, and returns false if it panicked.
+func runWorker(name string, worker func(work *interface{})) (done bool) {
+	var work interface{}
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint32(&stats.Panics, 1)
+			errorf("Restarting %s after panic: %v\nWhile processing: %+v\n%s",
+				name, r, work, debug.Stack())
+		}
+	}()
+
+	worker(&work)
+	return true
+}
+
+// runReader parses tweets from the stream and hands them over to the committers.
+func runReader(c *y.Closer, tweets <-chan interface{}, upserts chan<- *upsert,
+	work *interface{}) {
+
+	if tweets == nil {
+		return
+	}
+
+	for {
+		ingestion.wait(c)
+
+		select {
+		case <-c.HasBeenClosed():
+			return
+
+		case jsn, more := <-tweets:
+			if !more {
+				return
+			}
+
+			*work = jsn
+			var u *upsert
+			if notice, ok := jsn.(anaconda.StatusDeletionNotice); ok {
+				u = newDeletion(notice)
+			} else if u = newUpsert(jsn); u == nil {
+				continue
+			}
+
+			select {
+			case <-c.HasBeenClosed():
+				return
+			case upserts <- u:
+			}
+		}
+	}
+}
+
+func newUpsert(jsn interface{}) *upsert {
+	atomic.AddUint32(&stats.Tweets, 1)
+
+	ft, err := filterTweet(jsn)
+	if err == errFiltered {
+		return nil
+	}
+	if err != nil {
+		atomic.AddUint32(&stats.ErrorsJSON, 1)
+		debugf("Unable to filter tweet: %v\n", err)
+		return nil
+	}
+
+	// Now, we need query UIDs and ensure they don't already exists
+	queryStr, vars := buildQuery(ft)
+	if opts.BlindInsert {
+		blankNodes(ft)
+		queryStr, vars = "", nil
+	}
+
+	var profiles []twitterUser
+	if opts.ProfilePolicy != "always" {
+		profiles = splitProfiles(ft)
+	}
+
+	tweet, err := marshalMutation(ft)
+	if err != nil {
+		atomic.AddUint32(&stats.ErrorsJSON, 1)
+		return nil
+	}
+
+	var cond string
+	if opts.InsertOnly {
+		cond = "@if(eq(len(t), 0))"
+	}
+
+	var profileMutations []*api.Mutation
+	for _, profile := range profiles {
+		profileJSON, err := marshalMutation(profile)
+		if err != nil {
+			atomic.AddUint32(&stats.ErrorsJSON, 1)
+			return nil
+		}
+
+		varName := "p" + strings.TrimSuffix(strings.TrimPrefix(profile.UID, "uid("), ")")
+		profileCond := fmt.Sprintf("@if(eq(len(%s), 0))", varName)
+		if opts.InsertOnly {
+			profileCond = fmt.Sprintf("@if(eq(len(t), 0) AND eq(len(%s), 0))", varName)
+		}
+		profileMutations = append(profileMutations, &api.Mutation{
+			SetJson: profileJSON,
+			Cond:    profileCond,
+		})
+	}
+
+	if opts.DebugQueryEvery > 0 &&
+		atomic.AddUint32(&numUpserts, 1)%opts.DebugQueryEvery == 0 {
+		debugf("Query: %s, vars: %v, mutation: %s\n", queryStr, vars, tweet)
+	}
+
+	return &upsert{
+		tweet: ft,
+		query: queryStr,
+		vars:  vars,
+		mutation: &api.Mutation{
+			SetJson: tweet,
+			Cond:    cond,
+		},
+		profiles: profileMutations,
+	}
+}
+
+// blankNodes turns the variables the tweet refers to into blank nodes, so that it is
+// set without the query. New nodes are created for the tweet and all of its users
+// every time, duplicates are left to be removed offline.
+func blankNodes(tweet *twitterTweet) {
+	blank := func(uid string) string {
+		return "_:" + strings.TrimSuffix(strings.TrimPrefix(uid, "uid("), ")")
+	}
+
+	tweet.UID = blank(tweet.UID)
+	tweet.Author.UID = blank(tweet.Author.UID)
+	for i := range tweet.Mention {
+		tweet.Mention[i].UID = blank(tweet.Mention[i].UID)
+	}
+	for i := range tweet.Tagged {
+		tweet.Tagged[i].UID = blank(tweet.Tagged[i].UID)
+	}
+	if tweet.ReplyTo != nil {
+		tweet.ReplyTo.UID = blank(tweet.ReplyTo.UID)
+	}
+	if tweet.ReplyToUser != nil {
+		tweet.ReplyToUser.UID = blank(tweet.ReplyToUser.UID)
+	}
+}
+
+// marshalMutation marshals v into the JSON of a mutation, with the data mapping applied.
+func marshalMutation(v interface{}) ([]byte, error) {
+	jsn, err := jsonMarshal(v)
+	if err == nil && !opts.Mapping.isDefault() {
+		jsn = opts.Mapping.renameKeys(jsn)
+	}
+	return jsn, err
+}
+
+// splitProfiles strips the users of the tweet down to what links them to it, and
+// returns their profiles, to be set by mutations conditional on -profile_policy.
+func splitProfiles(tweet *twitterTweet) []twitterUser {
+	var profiles []twitterUser
+	seen := make(map[string]bool)
+	split := func(user *twitterUser, observedAt string) {
+		if !seen[user.UID] {
+			seen[user.UID] = true
+
+			profile := *user
+			profile.UserID = ""
+			profile.DgraphType = ""
+			profile.ProfileAt = observedAt
+			if profile != (twitterUser{UID: user.UID}) {
+				profiles = append(profiles, profile)
+			}
+		}
+
+		*user = twitterUser{
+			UID:        user.UID,
+			DgraphType: user.DgraphType,
+			UserID:     user.UserID,
+			SourceTag:  user.SourceTag,
+		}
+	}
+
+	// the author comes first, a mention of the author doesn't replace the full profile
+	split(&tweet.Author, tweet.CreatedAt)
+	for i := range tweet.Mention {
+		split(&tweet.Mention[i], "")
+	}
+	if tweet.ReplyToUser != nil {
+		split(tweet.ReplyToUser, "")
+	}
+
+	return profiles
+}
+
+// newDeletion removes the tweet that the stream notified as deleted, if it was stored.
+func newDeletion(notice anaconda.StatusDeletionNotice) *upsert {
+	return &upsert{
+		query: fmt.Sprintf(`query q($t: string) { t as var(func: eq(%s, $t)) }`,
+			opts.Mapping.TweetKey),
+		vars: map[string]string{"$t": notice.IdStr},
+		mutation: &api.Mutation{
+			DelNquads: []byte(`uid(t) * * .`),
+			Cond:      "@if(gt(len(t), 0))",
+		},
+		deletion: true,
+	}
+}
+
+// runCommitter runs the upserts handed over by the readers against every cluster. It
+// keeps running until the readers are done, so that parsed tweets are flushed on shutdown.
+func runCommitter(pools []*alphaPool, upserts <-chan *upsert, work *interface{}) {
+	// stagger the first transactions of the committers to avoid a burst of aborts
+	if opts.StartJitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(opts.StartJitter))))
+	}
+
+	if opts.MutationsPerTxn <= 1 {
+		for u := range upserts {
+			*work = u
+			commitToAll(pools, u)
+		}
+		return
+	}
+
+	// the open transactions are committed early when the schema is reloaded
+	batches := make([]txnBatch, len(pools))
+	open := false
+	defer func() {
+		// release the schema if the committer panics in the middle of a batch
+		if open {
+			liveSchema.RUnlock()
+		}
+	}()
+	flush := func() {
+		for i, pool := range pools {
+			batches[i].commit(pool, flushTrigger)
+		}
+		if open {
+			liveSchema.RUnlock()
+			open = false
+		}
+	}
+
+	// the timer is armed for the deadline of the oldest open batch, if any
+	timer := time.NewTimer(time.Hour)
+	stopTimer(timer)
+	var armed time.Time
+	for {
+		var expired <-chan time.Time
+		if oldest := oldestBatch(batches); opts.BatchDeadline > 0 && !oldest.IsZero() {
+			if !oldest.Equal(armed) {
+				stopTimer(timer)
+				timer.Reset(time.Until(oldest.Add(opts.BatchDeadline)))
+				armed = oldest
+			}
+			expired = timer.C
+		}
+
+		reload := liveSchema.upcoming()
+		select {
+		case u, more := <-upserts:
+			if !more {
+				flush()
+				return
+			}
+
+			*work = u
+			if !open {
+				liveSchema.RLock()
+				open = true
+			}
+			for i, pool := range pools {
+				batches[i].add(pool, u)
+			}
+		case <-expired:
+			armed = time.Time{}
+			for i, pool := range pools {
+				if batches[i].txn != nil && time.Since(batches[i].started) >= opts.BatchDeadline {
+					batches[i].commit(pool, deadlineTrigger)
+				}
+			}
+			if open && oldestBatch(batches).IsZero() {
+				liveSchema.RUnlock()
+				open = false
+			}
+		case <-reload.drain:
+			flush()
+			<-reload.done
+		}
+	}
+}
+
+// stopTimer stops the timer, draining its channel if it had already fired.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// oldestBatch returns when the oldest of the open batches was started, zero if none is.
+func oldestBatch(batches []txnBatch) time.Time {
+	var oldest time.Time
+	for i := range batches {
+		if batches[i].txn != nil && (oldest.IsZero() || batches[i].started.Before(oldest)) {
+			oldest = batches[i].started
+		}
+	}
+	return oldest
+}
+
+func commitToAll(pools []*alphaPool, u *upsert) {
+	liveSchema.RLock()
+	defer liveSchema.RUnlock()
+
+	for _, pool := range pools {
+		commitUpsert(pool, u)
+	}
+}
+
+func commitUpsert(pool *alphaPool, u *upsert) {
+	alpha := pool.pick()
+	txn := alpha.dgr.NewTxn()
+	// txn is not being discarded deliberately
+	// defer txn.Discard()
+
+	commitNow := true
+	if !u.deletion && rand.Float64() < opts.NoCommitRatio {
+		commitNow = false
+	}
+
+	// only ONE retry attempt is made, on top of the retries while overloaded
+	retry := true
+	overloadRetries := 0
+RETRY:
+	apiUpsert := &api.Request{
+		Mutations: u.mutations(),
+		CommitNow: commitNow,
+		Query:     u.query,
+		Vars:      u.vars,
+	}
+	overload.wait()
+	start := time.Now()
+	resp, err := txn.Do(context.Background(), apiUpsert)
+	if err == nil {
+		overload.success()
+		if commitNow {
+			latency := time.Since(start)
+			commitLatency.record(latency)
+			alpha.stats.latency.record(latency)
+		}
+	}
+	switch {
+	case err == nil && u.deletion:
+		pool.success(alpha)
+		atomic.AddUint32(&stats.Deletes, 1)
+	case err == nil && opts.InsertOnly && tweetExists(resp):
+		pool.success(alpha)
+		atomic.AddUint32(&stats.Skipped, 1)
+	case err == nil:
+		pool.success(alpha)
+		if commitNow {
+			atomic.AddUint32(&stats.Commits, 1)
+			atomic.AddUint32(&pool.commits, 1)
+			verifyCommit(alpha, u)
+		} else {
+			atomic.AddUint32(&stats.LeakedCommits, 1)
+		}
+	case strings.Contains(err.Error(), "connection refused"):
+		pool.countErrors(alpha, 1)
+		if !pool.failure(alpha) {
+			// wait for alpha to (re)start
+			warnf("Connection refused... waiting a bit\n")
+			time.Sleep(5 * time.Second)
+		}
+		deadLetters.write(u, err)
+	case isOverloaded(err):
+		overload.overloaded()
+		atomic.AddUint32(&stats.Overloaded, 1)
+		pool.countErrors(alpha, 1)
+		if overloadRetries < cMaxOverloadRetries {
+			// the failed txn is discarded, the retry waits for the backoff in a new one
+			overloadRetries++
+			txn = alpha.dgr.NewTxn()
+			goto RETRY
+		}
+		deadLetters.write(u, err)
+	case strings.Contains(err.Error(), "already been committed or discarded"):
+		atomic.AddUint32(&stats.Failures, 1)
+		pool.countErrors(alpha, 1)
+		deadLetters.write(u, err)
+	case retry && strings.Contains(err.Error(), "Please retry"):
+		atomic.AddUint32(&stats.Retries, 1)
+		time.Sleep(100 * time.Millisecond)
+		retry = false
+		goto RETRY
+	default:
+		atomic.AddUint32(&stats.ErrorsDgraph, 1)
+		pool.countErrors(alpha, 1)
+		warnf("Unable to commit: %v\n", err)
+		deadLetters.write(u, err)
+		if isUnexpected(err) {
+			// a second abort lands here too, it is not unexpected
+			failFast(u, err)
+		}
+	}
+}
+
+// txnBatch runs upserts in a single transaction with CommitNow=false, and commits it
+// explicitly once -mutations_per_txn upserts have been applied, or once -batch_deadline
+// has passed since it was started.
+type txnBatch struct {
+	alpha   *alphaConn
+	txn     *dgo.Txn
+	started time.Time
+	upserts []*upsert
+}
+
+// the reasons a batch is committed for
+const (
+	flushTrigger = iota
+	sizeTrigger
+	deadlineTrigger
+)
+
+// the commit latencies of batches committed by size and by deadline, to tell if either
+// trigger makes for slower commits
+var sizeCommitLatency, deadlineCommitLatency latencyRecorder
+
+// reportCommitTriggers prints the number and latencies of the batches committed once
+// full against those committed on -batch_deadline.
+func reportCommitTriggers() {
+	if opts.BatchDeadline <= 0 {
+		return
+	}
+
+	sizeCount, sizeAvg, sizeP99 := sizeCommitLatency.stats()
+	deadlineCount, deadlineAvg, deadlineP99 := deadlineCommitLatency.stats()
+	log.Printf("TRIGGERS commits/avg/p99 size: %d/%v/%v, deadline: %d/%v/%v\n",
+		sizeCount, sizeAvg.Round(time.Microsecond), sizeP99.Round(time.Microsecond),
+		deadlineCount, deadlineAvg.Round(time.Microsecond), deadlineP99.Round(time.Microsecond))
+}
+
+func (b *txnBatch) add(pool *alphaPool, u *upsert) {
+	if b.txn == nil {
+		b.alpha = pool.pick()
+		b.txn = b.alpha.dgr.NewTxn()
+		b.started = time.Now()
+	}
+
+	apiUpsert := &api.Request{
+		Mutations: u.mutations(),
+		Query:     u.query,
+		Vars:      u.vars,
+	}
+	overload.wait()
+	resp, err := b.txn.Do(context.Background(), apiUpsert)
+	if err == nil {
+		overload.success()
+	}
+	switch {
+	case err == nil && !u.deletion && opts.InsertOnly && tweetExists(resp):
+		atomic.AddUint32(&stats.Skipped, 1)
+	case err == nil:
+		b.upserts = append(b.upserts, u)
+	default:
+		// the transaction can't be committed anymore, drop all of its upserts
+		b.upserts = append(b.upserts, u)
+		b.fail(pool, err)
+		return
+	}
+
+	if len(b.upserts) >= opts.MutationsPerTxn {
+		b.commit(pool, sizeTrigger)
+	}
+}
+
+func (b *txnBatch) commit(pool *alphaPool, trigger int) {
+	if b.txn == nil {
+		return
+	}
+
+	start := time.Now()
+	if err := b.txn.Commit(context.Background()); err != nil {
+		b.fail(pool, err)
+		return
+	}
+	latency := time.Since(start)
+	commitLatency.record(latency)
+	b.alpha.stats.latency.record(latency)
+	switch trigger {
+	case sizeTrigger:
+		atomic.AddUint32(&stats.SizeCommits, 1)
+		sizeCommitLatency.record(latency)
+	case deadlineTrigger:
+		atomic.AddUint32(&stats.DeadlineCommits, 1)
+		deadlineCommitLatency.record(latency)
+	}
+
+	pool.success(b.alpha)
+	for _, u := range b.upserts {
+		if u.deletion {
+			atomic.AddUint32(&stats.Deletes, 1)
+		} else {
+			atomic.AddUint32(&stats.Commits, 1)
+			atomic.AddUint32(&pool.commits, 1)
+			verifyCommit(b.alpha, u)
+		}
+	}
+	b.reset()
+}
+
+func (b *txnBatch) fail(pool *alphaPool, err error) {
+	_ = b.txn.Discard(context.Background())
+	pool.countErrors(b.alpha, len(b.upserts))
+
+	switch {
+	case strings.Contains(err.Error(), "connection refused"):
+		if !pool.failure(b.alpha) {
+			warnf("Connection refused... waiting a bit\n")
+			time.Sleep(5 * time.Second)
+		}
+		atomic.AddUint32(&stats.Failures, uint32(len(b.upserts)))
+	case isOverloaded(err):
+		overload.overloaded()
+		atomic.AddUint32(&stats.Overloaded, uint32(len(b.upserts)))
+	case strings.Contains(err.Error(), "Please retry"):
+		atomic.AddUint32(&stats.Failures, uint32(len(b.upserts)))
+	default:
+		atomic.AddUint32(&stats.ErrorsDgraph, uint32(len(b.upserts)))
+		warnf("Unable to commit %d mutations: %v\n", len(b.upserts), err)
+	}
+
+	for _, u := range b.upserts {
+		deadLetters.write(u, err)
+	}
+	if isUnexpected(err) && len(b.upserts) > 0 {
+		// the last upsert is the one that failed, unless the commit did
+		failFast(b.upserts[len(b.upserts)-1], err)
+	}
+	b.reset()
+}
+
+// isUnexpected reports whether err is neither a connection, overload nor abort error,
+// the same way fail counts it.
+func isUnexpected(err error) bool {
+	return !strings.Contains(err.Error(), "connection refused") && !isOverloaded(err) &&
+		!strings.Contains(err.Error(), "Please retry")
+}
+
+var failFastOnce sync.Once
+
+// failFast dumps the upsert that failed with an unexpected dgraph error, and exits with
+// -fail_fast. Only the first failure is dumped, the other committers wait for the exit.
+func failFast(u *upsert, err error) {
+	if !opts.FailFast {
+		return
+	}
+
+	failFastOnce.Do(func() {
+		errorf("Stopping on the first unexpected dgraph error with -fail_fast: %v\n", err)
+		if u.tweet != nil {
+			errorf("Tweet: %v\n", u.tweet.IDStr)
+		}
+		errorf("Query: %s, vars: %v\n", u.query, u.vars)
+		for _, m := range u.mutations() {
+			errorf("Mutation: cond: %q, set: %s, delete: %s\n", m.Cond, m.SetJson, m.DelNquads)
+		}
+
+		deadLetters.close()
+		os.Exit(1)
+	})
+}
+
+func (b *txnBatch) reset() {
+	b.alpha = nil
+	b.txn = nil
+	b.upserts = b.upserts[:0]
+}
+
+// deadLetterWriter appends the tweets that could not be committed to a file, along
+// with the reason, so that they can be inspected and replayed later.
+type deadLetterWriter struct {
+	sync.Mutex
+	fd *os.File
+	w  *bufio.Writer
+}
+
+func newDeadLetterWriter(path string) *deadLetterWriter {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	checkFatal(err, "error in opening dead letter file: %v", path)
+
+	return &deadLetterWriter{fd: fd, w: bufio.NewWriter(fd)}
+}
+
+func (d *deadLetterWriter) write(u *upsert, reason error) {
+	if d == nil || u.tweet == nil {
+		return
+	}
+
+	line, err := json.Marshal(struct {
+		Time   string          `json:"time"`
+		Reason string          `json:"reason"`
+		Tweet  json.RawMessage `json:"tweet"`
+	}{
+		Time:   time.Now().Format(time.RFC3339),
+		Reason: reason.Error(),
+		Tweet:  u.mutation.SetJson,
+	})
+	if err != nil {
+		errorf("Unable to marshal dead letter: %v\n", err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, err := d.w.Write(append(line, '\n')); err != nil {
+		errorf("Unable to write dead letter: %v\n", err)
+	}
+}
+
+func (d *deadLetterWriter) close() {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	checkFatal(d.w.Flush(), "error in flushing dead letter file")
+	checkFatal(d.fd.Close(), "error in closing dead letter file")
+}
+
+// tweetExists reports whether the query in an insert only upsert found the tweet.
+func tweetExists(resp *api.Response) bool {
+	var r struct {
+		Existing []struct {
+			UID string `json:"uid"`
+		} `json:"existing"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		return false
+	}
+
+	return len(r.Existing) > 0
+}
+
+// verifyCommit reads back a sample of the committed tweets, and counts those that
+// are missing or don't have the message that was written.
+func verifyCommit(alpha *alphaConn, u *upsert) {
+	if opts.VerifySampleRate <= 0 || rand.Float64() >= opts.VerifySampleRate {
+		return
+	}
+
+	q := fmt.Sprintf(`query q($t: string) { t(func: eq(%s, $t)) { message } }`,
+		opts.Mapping.TweetKey)
+	resp, err := alpha.dgr.NewReadOnlyTxn().QueryWithVars(context.Background(), q,
+		map[string]string{"$t": u.tweet.IDStr})
+	if err != nil {
+		warnf("Unable to verify tweet %v: %v\n", u.tweet.IDStr, err)
+		return
+	}
+
+	var r struct {
+		T []struct {
+			Message string `json:"message"`
+		} `json:"t"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		warnf("Unable to verify tweet %v: %v\n", u.tweet.IDStr, err)
+		return
+	}
+
+	for _, t := range r.T {
+		if t.Message == u.tweet.Message {
+			return
+		}
+	}
+
+	atomic.AddUint32(&stats.VerifyFailures, 1)
+	warnf("Verification failed for tweet %v, found %d tweets with another message\n",
+		u.tweet.IDStr, len(r.T))
+}
+
+// langAllowed reports whether a tweet in the language is kept with -only_lang, and
+// counts the tweets that are dropped.
+func langAllowed(lang string) bool {
+	if opts.OnlyLang == "" || lang == opts.OnlyLang {
+		return true
+	}
+
+	atomic.AddUint32(&stats.LangSkipped, 1)
+	return false
+}
+
+// followersAllowed reports whether a tweet by an author with the followers is kept with
+// -min_followers, and counts the tweets that are dropped. Unknown counts are taken as 0.
+func followersAllowed(followers *int) bool {
+	if opts.MinFollowers <= 0 || (followers != nil && *followers >= opts.MinFollowers) {
+		return true
+	}
+
+	atomic.AddUint32(&stats.SmallAuthors, 1)
+	return false
+}
+
+// filterHashtags keeps the hashtags matching -hashtag_filter.
+func filterHashtags(hashtags []string) []string {
+	kept := hashtags[:0]
+	for _, tag := range hashtags {
+		if opts.HashtagFilter.MatchString(tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// filterTweet maps a message from the stream into a tweet. It returns errFiltered for
+// tweets that are deliberately dropped, those are counted separately from errors.
+func filterTweet(jsn interface{}) (*twitterTweet, error) {
+	var ft *twitterTweet
+	var err error
+	switch msg := jsn.(type) {
+	case anaconda.Tweet:
+		if !langAllowed(msg.Lang) {
+			return nil, errFiltered
+		}
+		ft, err = filterAnacondaTweet(msg)
+	case mastodonStatus:
+		if !langAllowed(msg.Language) {
+			return nil, errFiltered
+		}
+		ft, err = filterStatus(msg)
+	case *twitterTweet:
+		// synthetic tweets are generated in their final shape
+		ft = msg
+	default:
+		return nil, errNotATweet
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !followersAllowed(ft.Author.FollowersCount) {
+		return nil, errFiltered
+	}
+	if opts.HashtagFilter != nil {
+		ft.HashTags = filterHashtags(ft.HashTags)
+		if len(ft.HashTags) == 0 && opts.DropUntagged {
+			atomic.AddUint32(&stats.Untagged, 1)
+			return nil, errFiltered
+		}
+	}
+
+	if !opts.StoreReplies {
+		ft.ReplyTo, ft.ReplyToUser = nil, nil
+	}
+	if !opts.StoreSensitive {
+		ft.PossiblySensitive = nil
+	}
+	if !opts.StoreWithheld {
+		ft.WithheldCountries, ft.WithheldScope = nil, ""
+	}
+
+	if opts.SourceTag != "" {
+		ft.SourceTag = opts.SourceTag
+		ft.Author.SourceTag = opts.SourceTag
+		for i := range ft.Mention {
+			ft.Mention[i].SourceTag = opts.SourceTag
+		}
+		if ft.ReplyToUser != nil {
+			ft.ReplyToUser.SourceTag = opts.SourceTag
+		}
+	}
+	if mentions != nil {
+		mentions.addMentions(ft)
+	}
+	if opts.SkipMentionNodes {
+		for _, user := range ft.Mention {
+			if user.ScreenName != "" {
+				ft.MentionNames = append(ft.MentionNames, user.ScreenName)
+			}
+		}
+		ft.Mention = nil
+	}
+	if opts.HashtagNodes {
+		ft.Tagged = hashtagNodes(ft.HashTags)
+	}
+	if opts.StoreRunID {
+		ft.RunID = opts.RunID
+	}
+	if opts.EpochTimestamp {
+		createdAt, err := time.Parse(cDgraphTimeFormat, ft.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		ft.CreatedAtEpoch = createdAt.Unix()
+	}
+
+	return ft, nil
+}
+
+// hashtagNodes returns a node per distinct hashtag, hashtags differing only in case
+// are the same hashtag.
+func hashtagNodes(hashtags []string) []twitterHashtag {
+	var nodes []twitterHashtag
+	seen := make(map[string]bool)
+	for _, tag := range hashtags {
+		tag = strings.ToLower(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		nodes = append(nodes, twitterHashtag{DgraphType: "Hashtag", Tag: tag})
+	}
+
+	return nodes
+}
+
+func filterAnacondaTweet(tweet anaconda.Tweet) (*twitterTweet, error) {
+	createdAt, err := createdAtLayouts.parse(tweet.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tweets longer than 140 characters arrive truncated in the stream, with the full
+	// text and entities in the extended tweet. anaconda's Tweet.UnmarshalJSON already
+	// moves those into FullText and Entities, so truncated tweets need no special case.
+	message := tweet.FullText
+
+	// older archives only carry the truncated text
+	if message == "" {
+		message = tweet.Text
+	}
+	if message == "" {
+		atomic.AddUint32(&stats.EmptyMessages, 1)
+	}
+
+	expandedURLs := make([]string, len(tweet.Entities.Urls))
+	for _, url := range tweet.Entities.Urls {
+		expandedURLs = append(expandedURLs, url.Expanded_url)
+	}
+
+	hashTagTexts := make([]string, 0)
+	for _, tag := range tweet.Entities.Hashtags {
+		if tag.Text != "" {
+			hashTagTexts = append(hashTagTexts, tag.Text)
+		}
+	}
+
+	// The same account can be mentioned more than once in a tweet, keep a single
+	// entry per user_id and fill in any fields missing from the first occurrence.
+	var userMentions []twitterUser
+	mentionIndex := make(map[string]int)
+	for _, userMention := range tweet.Entities.User_mentions {
+		if userMention.Id_str == "" {
+			continue
+		}
+
+		if i, ok := mentionIndex[userMention.Id_str]; ok {
+			if userMentions[i].UserName == "" {
+				userMentions[i].UserName = userMention.Name
+			}
+			if userMentions[i].ScreenName == "" {
+				userMentions[i].ScreenName = userMention.Screen_name
+			}
+			continue
+		}
+
+		mentionIndex[userMention.Id_str] = len(userMentions)
+		userMentions = append(userMentions, twitterUser{
+			UserID:     userMention.Id_str,
+			DgraphType: opts.Mapping.UserType,
+			UserName:   userMention.Name,
+			ScreenName: userMention.Screen_name,
+		})
+	}
+
+	author := twitterUser{
+		UserID:           tweet.User.IdStr,
+		DgraphType:       opts.Mapping.UserType,
+		UserName:         tweet.User.Name,
+		ScreenName:       tweet.User.ScreenName,
+		Description:      tweet.User.Description,
+		FriendsCount:     intValue(tweet.User.FriendsCount),
+		FollowersCount:   intValue(tweet.User.FollowersCount),
+		Verified:         boolValue(tweet.User.Verified),
+		ProfileBannerURL: tweet.User.ProfileBannerURL,
+		ProfileImageURL:  tweet.User.ProfileImageURL,
+	}
+	if opts.CountFacets {
+		// the counts in the user profile are as of the time the tweet was created
+		author.FriendsCountAt = createdAt.Format(cDgraphTimeFormat)
+		author.FollowersCountAt = createdAt.Format(cDgraphTimeFormat)
+	}
+
+	ft := &twitterTweet{
+		IDStr:       tweet.IdStr,
+		DgraphType:  opts.Mapping.TweetType,
+		CreatedAt:   createdAt.Format(cDgraphTimeFormat),
+		Message:     message,
+		URLs:        expandedURLs,
+		HashTags:    hashTagTexts,
+		Author:      author,
+		Mention:     userMentions,
+		Retweet:     tweet.Retweeted,
+		ReplyTo:     newReplyTo(tweet.InReplyToStatusIdStr),
+		ReplyToUser: newReplyToUser(tweet.InReplyToUserIdStr, tweet.InReplyToScreenName),
+
+		PossiblySensitive: boolValue(tweet.PossiblySensitive),
+		WithheldCountries: tweet.WithheldInCountries,
+		WithheldScope:     tweet.WithheldScope,
+	}
+	if opts.EntityIndices {
+		if ft.Entities, err = entitySpans(tweet.Entities); err != nil {
+			return nil, err
+		}
+	}
+	if opts.StoreEngagement {
+		ft.RetweetCount = intValue(tweet.RetweetCount)
+		ft.FavoriteCount = intValue(tweet.FavoriteCount)
+	}
+
+	return ft, nil
+}
+
+// entitySpans returns the hashtags, mentions and urls of a tweet, along with their
+// offsets in the message, as a JSON array sorted by offset.
+func entitySpans(entities anaconda.Entities) (string, error) {
+	var spans []entitySpan
+	add := func(typ, text string, indices []int) {
+		if len(indices) == 2 {
+			spans = append(spans, entitySpan{Type: typ, Text: text, Start: indices[0], End: indices[1]})
+		}
+	}
+
+	for _, tag := range entities.Hashtags {
+		add("hashtag", tag.Text, tag.Indices)
+	}
+	for _, mention := range entities.User_mentions {
+		add("mention", mention.Screen_name, mention.Indices)
+	}
+	for _, url := range entities.Urls {
+		add("url", url.Expanded_url, url.Indices)
+	}
+	if len(spans) == 0 {
+		return "", nil
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+	jsn, err := json.Marshal(spans)
+	return string(jsn), err
+}
+
+// intValue returns the value to store for a count, nil leaves the predicate unset. A zero
+// count is only stored with -store_zero_values, so that it is told apart from unknown.
+func intValue(n int) *int {
+	if n == 0 && !opts.StoreZeroValues {
+		return nil
+	}
+	return &n
+}
+
+func boolValue(b bool) *bool {
+	if !b && !opts.StoreZeroValues {
+		return nil
+	}
+	return &b
+}
+
+func newReplyTo(idStr string) *twitterTweetRef {
+	if idStr == "" {
+		return nil
+	}
+
+	return &twitterTweetRef{IDStr: idStr, DgraphType: opts.Mapping.TweetType}
+}
+
+func newReplyToUser(userID, screenName string) *twitterUser {
+	if userID == "" {
+		return nil
+	}
+
+	return &twitterUser{
+		UserID:     userID,
+		DgraphType: opts.Mapping.UserType,
+		ScreenName: screenName,
+	}
+}
+
+func readCredentials(path string) twitterCreds {
+	jsn, err := ioutil.ReadFile(path)
+	checkFatal(err, "Unable to open twitter credentials file '%s'", path)
+
+	var creds twitterCreds
+	err = json.Unmarshal(jsn, &creds)
+	checkFatal(err, "Unable to parse twitter credentials file '%s'", path)
+
+	return creds
+}
+
+func newTwitterClient(creds twitterCreds) *anaconda.TwitterApi {
+	client := anaconda.NewTwitterApiWithCredentials(
+		creds.AccessToken, creds.AccessSecret,
+		creds.ConsumerKey, creds.ConsumerSecret,
+	)
+
+	// anaconda queues queries through a token bucket only when throttling is enabled,
+	// SetDelay must therefore follow EnableThrottling.
+	if opts.TwitterDelay > 0 {
+		client.EnableThrottling(opts.TwitterDelay, opts.TwitterBuffer)
+		client.SetDelay(opts.TwitterDelay)
+	} else {
+		client.DisableThrottling()
+	}
+	client.ReturnRateLimitError(opts.TwitterRateError)
+
+	ok, err := client.VerifyCredentials()
+	checkFatal(err, "error in verifying credentials")
+	if !ok {
+		checkFatal(errors.New("invalid credentials"), "twitter")
+	}
+
+	return client
+}
+
+func newAPIClients(sockAddr []string) []api.DgraphClient {
+	var clients []api.DgraphClient
+
+	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+	if opts.GrpcCompressor != "" {
+		// Compressing the JSON mutations cuts the bandwidth to the alphas several fold,
+		// at the cost of CPU on both ends. It only pays off on constrained links.
+		dialOpts = append(dialOpts,
+			grpc.WithDefaultCallOptions(grpc.UseCompressor(opts.GrpcCompressor)))
+	}
+
+	for _, sa := range sockAddr {
+		if opts.WaitConnect <= 0 {
+			conn, err := grpc.Dial(sa, dialOpts...)
+			checkFatal(err, "Unable to connect to dgraph")
+			clients = append(clients, api.NewDgraphClient(conn))
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.WaitConnect)
+		conn, err := grpc.DialContext(ctx, sa, append(dialOpts, grpc.WithBlock())...)
+		cancel()
+		checkFatal(err, "could not connect to %v", sa)
+		clients = append(clients, api.NewDgraphClient(conn))
+	}
+
+	return clients
+}
+
+// handleShutdown stops the pipeline gracefully on SIGINT or SIGTERM, once -run_for has
+// elapsed, or once the stream went quiet for -idle_timeout. The readers stop, and the
+// committers flush what was already parsed.
+func handleShutdown(c *y.Closer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	var runFor <-chan time.Time
+	if opts.RunFor > 0 {
+		runFor = time.After(opts.RunFor)
+	}
+
+	select {
+	case sig := <-sigs:
+		infof("Received %v, shutting down...\n", sig)
+	case <-runFor:
+		infof("Ran for %v, shutting down...\n", opts.RunFor)
+	case <-idleTimeout(c):
+		warnf("No tweet arrived for %v, shutting down...\n", opts.IdleTimeout)
+	case <-c.HasBeenClosed():
+		return
+	}
+
+	signal.Stop(sigs)
+	c.Signal()
+}
+
+// idleTimeout returns a channel that is closed once no tweet has arrived for
+// -idle_timeout, nil if it isn't set. Paused or backed up ingestion isn't idle.
+func idleTimeout(c *y.Closer) <-chan struct{} {
+	if opts.IdleTimeout <= 0 {
+		return nil
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		last, lastAt := atomic.LoadUint32(&stats.Tweets), time.Now()
+		for {
+			select {
+			case <-c.HasBeenClosed():
+				return
+			case now := <-ticker.C:
+				tweets := atomic.LoadUint32(&stats.Tweets)
+				if tweets != last || len(tweetChannel) > 0 || ingestion.paused() {
+					last, lastAt = tweets, now
+					continue
+				}
+
+				if now.Sub(lastAt) >= opts.IdleTimeout {
+					close(idle)
+					return
+				}
+			}
+		}
+	}()
+
+	return idle
+}
+
+// reportSummary prints the stats of the whole run.
+func reportSummary(elapsed time.Duration) {
+	s := snapshotStats()
+	log.Printf("SUMMARY ran for %v, tweets: %d, commits: %d, leaked: %d, json_errs: %d, "+
+		"retries: %d, skipped: %d, failures: %d, dgraph_errs: %d, deletes: %d, verify_fails: %d, "+
+		"overloaded: %d, lang_skipped: %d, small_authors: %d, untagged: %d, panics: %d, "+
+		"size_commits: %d, deadline_commits: %d\n",
+		elapsed.Round(time.Second), s.Tweets, s.Commits, s.LeakedCommits, s.ErrorsJSON,
+		s.Retries, s.Skipped, s.Failures, s.ErrorsDgraph, s.Deletes, s.VerifyFailures,
+		s.Overloaded, s.LangSkipped, s.SmallAuthors, s.Untagged, s.Panics, s.SizeCommits,
+		s.DeadlineCommits)
+	reportCommitTriggers()
+}
+
+// runHealthy reports whether the run had no dgraph errors, and failed to commit at most
+// -fail_threshold of the upserts it attempted.
+func runHealthy(s progStats) bool {
+	if s.ErrorsDgraph > 0 {
+		errorf("Run failed with %d dgraph errors\n", s.ErrorsDgraph)
+		return false
+	}
+
+	failed := s.Failures + s.Overloaded
+	attempted := s.Commits + s.LeakedCommits + s.Skipped + s.Deletes + failed
+	if attempted == 0 {
+		return true
+	}
+	if rate := float64(failed) / float64(attempted); rate > opts.FailThreshold {
+		errorf("Run failed with a failure rate of %.4f, above %v\n", rate, opts.FailThreshold)
+		return false
+	}
+
+	return true
+}
+
+// since returns the stats accumulated after old was taken.
+func (s progStats) since(old progStats) progStats {
+	diff := reflect.ValueOf(&s).Elem()
+	prev := reflect.ValueOf(old)
+	for i := 0; i < diff.NumField(); i++ {
+		diff.Field(i).SetUint(diff.Field(i).Uint() - prev.Field(i).Uint())
+	}
+	return s
+}
+
+// snapshotStats reads all the stats atomically.
+func snapshotStats() progStats {
+	return progStats{
+		Tweets:          atomic.LoadUint32(&stats.Tweets),
+		Commits:         atomic.LoadUint32(&stats.Commits),
+		LeakedCommits:   atomic.LoadUint32(&stats.LeakedCommits),
+		Retries:         atomic.LoadUint32(&stats.Retries),
+		Skipped:         atomic.LoadUint32(&stats.Skipped),
+		Failures:        atomic.LoadUint32(&stats.Failures),
+		ErrorsJSON:      atomic.LoadUint32(&stats.ErrorsJSON),
+		ErrorsDgraph:    atomic.LoadUint32(&stats.ErrorsDgraph),
+		EmptyMessages:   atomic.LoadUint32(&stats.EmptyMessages),
+		Deletes:         atomic.LoadUint32(&stats.Deletes),
+		VerifyFailures:  atomic.LoadUint32(&stats.VerifyFailures),
+		Overloaded:      atomic.LoadUint32(&stats.Overloaded),
+		LangSkipped:     atomic.LoadUint32(&stats.LangSkipped),
+		SmallAuthors:    atomic.LoadUint32(&stats.SmallAuthors),
+		Untagged:        atomic.LoadUint32(&stats.Untagged),
+		Panics:          atomic.LoadUint32(&stats.Panics),
+		SizeCommits:     atomic.LoadUint32(&stats.SizeCommits),
+		DeadlineCommits: atomic.LoadUint32(&stats.DeadlineCommits),
+	}
+}
+
+func reportStats(c *y.Closer) {
+	defer c.Done()
+
+	var oldStats, newStats progStats
+	infof("Reporting stats every %v seconds\n", opts.ReportPeriodSecs)
+	for {
+		newStats = snapshotStats()
+		log.Printf("STATS%s tweets: %d, commits: %d, leaked: %d, json_errs: %d, "+
+			"retries: %d, skipped: %d, failures: %d, dgraph_errs: %d, empty_msgs: %d, "+
+			"deletes: %d, verify_fails: %d, tweet_queue: %d/%d, upsert_queue: %d/%d, "+
+			"commit_rate: %d/sec, paused: %v, overloaded: %d, backoff: %v, lang_skipped: %d, "+
+			"small_authors: %d, untagged: %d, panics: %d, size_commits: %d, "+
+			"deadline_commits: %d\n",
+			warmup.mark(), newStats.Tweets, newStats.Commits, newStats.LeakedCommits,
+			newStats.ErrorsJSON,
+			newStats.Retries, newStats.Skipped, newStats.Failures, newStats.ErrorsDgraph,
+			newStats.EmptyMessages, newStats.Deletes, newStats.VerifyFailures,
+			len(tweetChannel), cap(tweetChannel), len(upsertChannel), cap(upsertChannel),
+			(newStats.Tweets-oldStats.Tweets)/uint32(opts.ReportPeriodSecs), ingestion.paused(),
+			newStats.Overloaded, overload.current(), newStats.LangSkipped, newStats.SmallAuthors,
+			newStats.Untagged, newStats.Panics, newStats.SizeCommits, newStats.DeadlineCommits)
+		if opts.Estimate {
+			users, tweets := estimator.estimates()
+			log.Printf("ESTIMATE distinct users: %d, distinct tweets: %d\n", users, tweets)
+		}
+		if mentions != nil {
+			log.Printf("TOP_MENTIONS %v\n", mentions)
+		}
+		if len(clusterPools) > 1 {
+			reportClusters()
+		}
+		reportAlphas()
+		statsCSV.write(newStats.since(oldStats))
+		statsd.write(oldStats, newStats)
+		checkFailureRate(oldStats, newStats)
+		oldStats = newStats
+
+		select {
+		case <-c.HasBeenClosed():
+			return
+		default:
+			time.Sleep(time.Second * time.Duration(opts.ReportPeriodSecs))
+		}
+	}
+}
+
+// reportClusters prints the commits and errors of every cluster when fanning out, along
+// with the divergence between the clusters with the most and the fewest commits.
+func reportClusters() {
+	var sb strings.Builder
+	var most, fewest uint32
+	for i, pool := range clusterPools {
+		commits := atomic.LoadUint32(&pool.commits)
+		errs := atomic.LoadUint32(&pool.errors)
+		fmt.Fprintf(&sb, "%s: %d/%d, ", pool.name, commits, errs)
+
+		if i == 0 || commits > most {
+			most = commits
+		}
+		if i == 0 || commits < fewest {
+			fewest = commits
+		}
+	}
+
+	log.Printf("CLUSTERS commits/errors %sdivergence: %d\n", sb.String(), most-fewest)
+}
+
+// reportAlphas prints the commits, latencies and errors of every alpha, to spot a slow
+// one among those the committers spread over. Nothing is printed for a single alpha.
+func reportAlphas() {
+	alphaStatsLock.Lock()
+	defer alphaStatsLock.Unlock()
+
+	if len(alphaStatsList) <= 1 {
+		return
+	}
+
+	var sb strings.Builder
+	for _, s := range alphaStatsList {
+		count, avg, p99 := s.latency.stats()
+		fmt.Fprintf(&sb, "%s: %d/%v/%v/%d, ", s.addr, count, avg.Round(time.Microsecond),
+			p99.Round(time.Microsecond), atomic.LoadUint32(&s.errors))
+	}
+
+	log.Printf("ALPHAS commits/avg/p99/errors %s\n", strings.TrimSuffix(sb.String(), ", "))
+}
+
+// checkFailureRate warns, and notifies the webhook if one is set, when the ratio of
+// failed to attempted commits in the last interval exceeds -max_failure_rate.
+func checkFailureRate(oldStats, newStats progStats) {
+	if opts.MaxFailureRate <= 0 {
+		return
+	}
+
+	failures := (newStats.Failures - oldStats.Failures) +
+		(newStats.ErrorsDgraph - oldStats.ErrorsDgraph) +
+		(newStats.Overloaded - oldStats.Overloaded)
+	commits := (newStats.Commits - oldStats.Commits) +
+		(newStats.LeakedCommits - oldStats.LeakedCommits)
+	if failures == 0 {
+		return
+	}
+
+	rate := float64(failures) / float64(failures+commits)
+	if rate <= opts.MaxFailureRate {
+		return
+	}
+
+	warnf("!!! failure rate %.2f exceeds %.2f, failures: %d, commits: %d !!!\n",
+		rate, opts.MaxFailureRate, failures, commits)
+	if opts.WebhookURL != "" {
+		go notifyWebhook(rate, failures, commits)
+	}
+}
+
+func notifyWebhook(rate float64, failures, commits uint32) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"text":      fmt.Sprintf("flock failure rate %.2f exceeds %.2f", rate, opts.MaxFailureRate),
+		"rate":      rate,
+		"threshold": opts.MaxFailureRate,
+		"failures":  failures,
+		"commits":   commits,
+		"alphas":    opts.AlphaSockAddr,
+	})
+	if err != nil {
+		errorf("Unable to marshal webhook payload: %v\n", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(opts.WebhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		errorf("Unable to notify webhook: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		errorf("Webhook returned status: %v\n", resp.Status)
+	}
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	_, err := crand.Read(b[:])
+	checkFatal(err, "Unable to generate a run id")
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func checkFatal(err error, format string, args ...interface{}) {
+	if err != nil {
+		msg := fmt.Sprintf(format, args...)
+		_, _ = fmt.Fprintf(os.Stderr, "%s :: %s\n", msg, err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	dgclients := flag.Int("l", 8, "number of goroutines parsing tweets")
+	committers := flag.Int("committers", 0,
+		"number of goroutines committing tweets to dgraph, defaults to the value of -l")
+	credentialsFile := flag.String("c", "credentials.json", "path to credentials file")
+	dataFilesPath := flag.String("d", "", "path containing json files with tweets in each line, "+
+		"- to read from stdin, or an http(s) URL of a file, which may be gzipped")
+	noCommitRatio := flag.Float64("p", 0, "prob of CommitNow=False, from 0.0 to 1.0")
+	alphasAddress := flag.String("a", ":9180,:9182,:9183",
+		"comma separated addresses to alphas, or name=alphas clusters separated by semicolons "+
+			"to write every tweet to each cluster, commits are then counted per cluster")
+	pprofAddr := flag.String("pprof_addr", "", "address to serve pprof handlers on, disabled if empty")
+	twitterDelay := flag.Duration("twitter_delay", 0,
+		"delay between throttled twitter API queries, throttling is disabled if 0")
+	twitterBuffer := flag.Int64("twitter_buffer", anaconda.DEFAULT_CAPACITY,
+		"number of twitter API queries allowed to burst when throttling is enabled")
+	twitterRateError := flag.Bool("twitter_rate_error", false,
+		"return twitter rate limit errors instead of queuing and retrying the query")
+	insertOnly := flag.Bool("insert_only", false,
+		"only insert new tweets, skipping the mutation for tweets that already exist")
+	jsonErrorSamples := flag.Int("json_error_samples", 0,
+		"number of lines failing to unmarshal to print at the end of the run")
+	debugQueryEvery := flag.Uint("debug_query", 0,
+		"log the upsert query and mutation of 1 in every N tweets with -v debug, disabled if 0")
+	maxConnFailures := flag.Int("max_conn_failures", 3,
+		"consecutive connection failures after which an alpha is removed from rotation, 0 to never remove")
+	probeInterval := flag.Duration("probe_interval", 30*time.Second,
+		"interval at which an alpha removed from rotation is probed for recovery")
+	countFacets := flag.Bool("count_facets", false,
+		"store the observation time as a facet on friends_count and followers_count")
+	jsonEncoder := flag.String("json_encoder", "std",
+		"JSON encoder for mutations, one of std or jsoniter")
+	estimate := flag.Bool("estimate", false,
+		"estimate distinct users and tweets in the stream without storing them in dgraph")
+	indexes := make(indexOverrides)
+	flag.Var(indexes, "index",
+		"override the index of a predicate as predicate=tokenizer[,tokenizer...], "+
+			"leave tokenizers empty to disable the index, can be repeated")
+	timeIndex := flag.String("time_index", "",
+		"granularity of the created_at index, one of year, month, day, hour or none, "+
+			"hour if empty; the index serves inequality functions on created_at, a coarser "+
+			"one is smaller but has more candidates to check")
+	var layouts layoutList
+	flag.Var(&layouts, "created_at_layout",
+		"Go time layout to parse the created_at of tweets with, or epoch for Unix timestamps "+
+			"in seconds or milliseconds, can be repeated to try several in order, the twitter "+
+			"layout, RFC3339 and epoch if not given")
+	waitConnect := flag.Duration("wait_connect", 0,
+		"wait up to this long for connections to alphas at startup, connect lazily if 0")
+	grpcCompress := flag.String("grpc_compress", "",
+		"compress gRPC traffic to alphas, gzip trades CPU for bandwidth, disabled if empty")
+	fileSampleRate := flag.Float64("file_sample_rate", 1,
+		"fraction of the files found with -d to replay, from 0.0 to 1.0")
+	seed := flag.Int64("seed", 0, "seed for random choices, a random seed is used if 0")
+	maxFailureRate := flag.Float64("max_failure_rate", 0,
+		"warn when the ratio of failed commits in a reporting interval exceeds this, disabled if 0")
+	webhookURL := flag.String("webhook_url", "",
+		"URL to POST a JSON alert to when -max_failure_rate is exceeded")
+	source := flag.String("source", "twitter", "source of the live stream, one of twitter or mastodon")
+	mastodonURL := flag.String("mastodon_url", "", "URL of the mastodon instance to stream from")
+	mastodonToken := flag.String("mastodon_token", "", "access token for the mastodon instance")
+	chanSize := flag.Int("chan_size", 1000, "capacity of the queues between the pipeline stages")
+	deadLetterPath := flag.String("dead_letter", "",
+		"file to append tweets that could not be committed to, along with the error")
+	mappingFile := flag.String("mapping", "",
+		"JSON file overriding the type names (tweet_type, user_type) and "+
+			"key predicates (tweet_key, user_key) written to dgraph")
+	benchmark := flag.Bool("benchmark", false,
+		"ingest the tweets in -d for -duration and print a throughput and latency report")
+	duration := flag.Duration("duration", time.Minute, "duration of the -benchmark run")
+	warmupDuration := flag.Duration("warmup", 0,
+		"time to run -benchmark for before measuring it, on top of -duration")
+	runFor := flag.Duration("run_for", 0, "stop gracefully after running for this long, disabled if 0")
+	sourceTag := flag.String("source_tag", "",
+		"value of the source_tag predicate stored on every tweet and user, not stored if empty")
+	topMentions := flag.Int("top_mentions", 0,
+		"number of most mentioned screen names to report every interval, disabled if 0")
+	mutationsPerTxn := flag.Int("mutations_per_txn", 1,
+		"number of upserts run in a transaction with CommitNow=false before committing it, "+
+			"each upsert commits on its own if 1")
+	batchDeadline := flag.Duration("batch_deadline", 0,
+		"commit a -mutations_per_txn transaction once this long has passed since its first "+
+			"upsert even if it isn't full, disabled if 0")
+	schemaAlpha := flag.String("schema_alpha", "",
+		"address of the alpha the schema is altered on, any of the alphas in -a if empty")
+	hashtagNodes := flag.Bool("hashtag_nodes", false,
+		"store each distinct hashtag as a Hashtag node linked from tweets with a tagged edge")
+	verifySampleRate := flag.Float64("verify_sample_rate", 0,
+		"fraction of committed tweets read back to verify they are stored, from 0.0 to 1.0")
+	startJitter := flag.Duration("start_jitter", 500*time.Millisecond,
+		"maximum random delay before each committer starts, disabled if 0")
+	storeZeroValues := flag.Bool("store_zero_values", false,
+		"store zero counts and false flags of users instead of leaving the predicates unset")
+	synthRate := flag.Float64("synth_rate", 0,
+		"generate this many synthetic tweets per second instead of reading a stream, disabled if 0")
+	synthUsers := flag.Int("synth_users", 10000, "number of distinct users authoring synthetic tweets")
+	epochTimestamp := flag.Bool("epoch_timestamp", false,
+		"also store created_at as Unix seconds in the created_at_epoch int predicate")
+	alterForever := flag.Bool("alter_forever", false,
+		"keep retrying the schema alteration with backoff instead of exiting after 3 attempts")
+	connsPerAlpha := flag.Int("conns_per_alpha", 1, "number of gRPC connections opened to each alpha")
+	runID := flag.String("run_id", "", "label of the run prefixed to every log line, a random UUID if empty")
+	storeRunID := flag.Bool("store_run_id", false, "store the run label in the run_id predicate of tweets")
+	profilePolicy := flag.String("profile_policy", "always",
+		"when to overwrite the stored profile of a user, one of always, never (only set it "+
+			"the first time) or newest (only if the tweet is newer than the stored profile)")
+	statsCSVPath := flag.String("stats_csv", "", "file to append the stats of every reporting interval to as CSV")
+	onlyLang := flag.String("only_lang", "", "only store tweets in this language, such as en, all if empty")
+	skipMentionNodes := flag.Bool("skip_mention_nodes", false,
+		"store the screen names of mentioned users in mention_names instead of linking User nodes")
+	freshnessProbes := flag.Int("freshness_probes", 0,
+		"instead of ingesting, commit this many synthetic tweets one at a time and report "+
+			"how long each takes to be readable, disabled if 0")
+	readWorkers := flag.Int("read_workers", 1, "number of files in -d read concurrently")
+	minFollowers := flag.Int("min_followers", 0,
+		"only store tweets whose author has at least this many followers, all if 0")
+	storeEngagement := flag.Bool("store_engagement", false,
+		"store the retweet and favorite counts of tweets in retweet_count and favorite_count")
+	liveSchemaPath := flag.String("live_schema_reload", "",
+		"schema file to alter the schema with on SIGHUP, once the transactions in flight "+
+			"are drained, disabled if empty")
+	failOnErrors := flag.Bool("fail_on_errors", false,
+		"exit with status 1 if the run had any dgraph error or a failure rate above -fail_threshold")
+	failThreshold := flag.Float64("fail_threshold", 0,
+		"highest fraction of attempted upserts that may fail with -fail_on_errors")
+	hashtagFilter := flag.String("hashtag_filter", "",
+		"only store the hashtags matching this regexp, such as ^covid, all if empty")
+	dropUntagged := flag.Bool("drop_untagged", false,
+		"drop the tweets left without any hashtag by -hashtag_filter")
+	blindInsert := flag.Bool("blind_insert", false,
+		"set tweets without the upsert query, creating new nodes for the tweet and its users "+
+			"every time, duplicates have to be removed offline")
+	statsdAddr := flag.String("statsd_addr", "",
+		"host:port of a statsd server to send the stats of every reporting interval to over UDP")
+	checkSchemaFlag := flag.Bool("check_schema", false,
+		"compare the existing schema of the clusters with the intended one at startup, and "+
+			"exit listing the predicates whose type, index or directives differ")
+	idleTimeoutFlag := flag.Duration("idle_timeout", 0,
+		"shut down gracefully once no tweet has arrived for this long, disabled if 0")
+	entityIndices := flag.Bool("entity_indices", false,
+		"store the offsets of the hashtags, mentions and urls in the message in entities")
+	failFastFlag := flag.Bool("fail_fast", false,
+		"exit with status 1 on the first dgraph error that isn't an abort, dumping the "+
+			"query and mutations of the upsert that failed")
+	var streams filteredStreams
+	flag.Var(&streams, "filtered_stream",
+		"stream the tweets tracking some terms with the twitter app whose credentials are in "+
+			"a file, as credentials=term[,term...], instead of the sample stream with -c, can "+
+			"be repeated to merge several streams")
+	bulkExportDir := flag.String("bulk_export", "",
+		"instead of storing tweets in dgraph, write them as RDF for the dgraph bulk loader, "+
+			"along with the schema, to this directory")
+	storeReplies := flag.Bool("store_replies", false,
+		"link replies to the tweet and user replied to with reply_to and reply_to_user")
+	storeSensitive := flag.Bool("store_sensitive", false,
+		"store whether tweets are flagged as possibly sensitive in possibly_sensitive")
+	storeWithheld := flag.Bool("store_withheld", false,
+		"store the countries tweets are withheld in, and the scope, in withheld_countries "+
+			"and withheld_scope")
+	flag.Var(&verbosity, "v", "log verbosity, one of error, warn, info or debug, "+
+		"the periodic stats are printed at every level")
+	flag.Parse()
+
+	if *noCommitRatio > 1 || *noCommitRatio < 0 {
+		log.Fatalf("invalid value for commit=false probability")
+	}
+	opts = progOptions{
+		NumClients:       *dgclients,
+		NumCommitters:    *committers,
+		CredentialsFile:  *credentialsFile,
+		DataFilesPath:    *dataFilesPath,
+		ReportPeriodSecs: 2,
+		NoCommitRatio:    *noCommitRatio,
+		PprofAddr:        *pprofAddr,
+		TwitterDelay:     *twitterDelay,
+		TwitterBuffer:    *twitterBuffer,
+		TwitterRateError: *twitterRateError,
+		InsertOnly:       *insertOnly,
+		JSONErrorSamples: *jsonErrorSamples,
+		DebugQueryEvery:  uint32(*debugQueryEvery),
+		MaxConnFailures:  *maxConnFailures,
+		ProbeInterval:    *probeInterval,
+		CountFacets:      *countFacets,
+		JSONEncoder:      *jsonEncoder,
+		Estimate:         *estimate,
+		WaitConnect:      *waitConnect,
+		GrpcCompressor:   *grpcCompress,
+		FileSampleRate:   *fileSampleRate,
+		Seed:             *seed,
+		MaxFailureRate:   *maxFailureRate,
+		WebhookURL:       *webhookURL,
+		Source:           *source,
+		MastodonURL:      *mastodonURL,
+		MastodonToken:    *mastodonToken,
+		ChanSize:         *chanSize,
+		DeadLetterPath:   *deadLetterPath,
+		Mapping:          readMapping(*mappingFile),
+		Benchmark:        *benchmark,
+		Warmup:           *warmupDuration,
+		Duration:         *duration,
+		RunFor:           *runFor,
+		SourceTag:        *sourceTag,
+		TopMentions:      *topMentions,
+		MutationsPerTxn:  *mutationsPerTxn,
+		BatchDeadline:    *batchDeadline,
+		SchemaAlpha:      *schemaAlpha,
+		HashtagNodes:     *hashtagNodes,
+		VerifySampleRate: *verifySampleRate,
+		StartJitter:      *startJitter,
+		StoreZeroValues:  *storeZeroValues,
+		SynthRate:        *synthRate,
+		SynthUsers:       *synthUsers,
+		EpochTimestamp:   *epochTimestamp,
+		AlterForever:     *alterForever,
+		ConnsPerAlpha:    *connsPerAlpha,
+		RunID:            *runID,
+		StoreRunID:       *storeRunID,
+		ProfilePolicy:    *profilePolicy,
+		StatsCSVPath:     *statsCSVPath,
+		OnlyLang:         *onlyLang,
+		SkipMentionNodes: *skipMentionNodes,
+		FreshnessProbes:  *freshnessProbes,
+		ReadWorkers:      *readWorkers,
+		MinFollowers:     *minFollowers,
+		StoreEngagement:  *storeEngagement,
+		LiveSchemaPath:   *liveSchemaPath,
+		FailOnErrors:     *failOnErrors,
+		FailThreshold:    *failThreshold,
+		DropUntagged:     *dropUntagged,
+		BlindInsert:      *blindInsert,
+		StatsdAddr:       *statsdAddr,
+		CheckSchema:      *checkSchemaFlag,
+		IdleTimeout:      *idleTimeoutFlag,
+		EntityIndices:    *entityIndices,
+		FailFast:         *failFastFlag,
+		StoreReplies:     *storeReplies,
+		StoreSensitive:   *storeSensitive,
+		StoreWithheld:    *storeWithheld,
+		FilteredStreams:  streams,
+		BulkExportDir:    *bulkExportDir,
+	}
+	if *hashtagFilter != "" {
+		re, err := regexp.Compile(*hashtagFilter)
+		checkFatal(err, "invalid value for hashtag filter")
+		opts.HashtagFilter = re
+	}
+
+	clusters, err := parseClusters(*alphasAddress)
+	checkFatal(err, "invalid value for alphas")
+	opts.Clusters = clusters
+	for _, cluster := range opts.Clusters {
+		opts.AlphaSockAddr = append(opts.AlphaSockAddr, cluster.Addrs...)
+	}
+	if opts.SchemaAlpha != "" && len(opts.Clusters) > 1 {
+		log.Fatalf("-schema_alpha cannot be combined with multiple clusters")
+	}
+
+	if opts.RunID == "" {
+		opts.RunID = newUUID()
+	}
+	log.SetPrefix("[" + opts.RunID + "] ")
+
+	switch {
+	case opts.Source != "twitter" && opts.Source != "mastodon":
+		log.Fatalf("invalid value for source: %v", opts.Source)
+	case opts.Source == "mastodon" && opts.MastodonURL == "":
+		log.Fatalf("mastodon source requires -mastodon_url")
+	}
+
+	if opts.MutationsPerTxn > 1 && opts.NoCommitRatio > 0 {
+		log.Fatalf("-mutations_per_txn cannot be combined with -p")
+	}
+
+	if opts.BatchDeadline < 0 || (opts.BatchDeadline > 0 && opts.MutationsPerTxn <= 1) {
+		log.Fatalf("-batch_deadline requires -mutations_per_txn greater than 1")
+	}
+
+	if opts.VerifySampleRate > 1 || opts.VerifySampleRate < 0 {
+		log.Fatalf("invalid value for verify sample rate")
+	}
+
+	switch opts.ProfilePolicy {
+	case "always", "never", "newest":
+	default:
+		log.Fatalf("invalid value for profile policy: %v", opts.ProfilePolicy)
+	}
+	if opts.BlindInsert && (opts.InsertOnly || opts.ProfilePolicy != "always") {
+		log.Fatalf("blind insert cannot be combined with -insert_only or -profile_policy")
+	}
+
+	if opts.ReadWorkers < 1 {
+		log.Fatalf("invalid value for read workers")
+	}
+
+	if opts.ConnsPerAlpha < 1 {
+		log.Fatalf("invalid value for connections per alpha")
+	}
+
+	if opts.SynthRate < 0 || opts.SynthUsers < 2 {
+		log.Fatalf("invalid value for synth rate or users")
+	}
+
+	if opts.FailThreshold < 0 || opts.FailThreshold > 1 {
+		log.Fatalf("invalid value for fail threshold")
+	}
+
+	if opts.FileSampleRate > 1 || opts.FileSampleRate <= 0 {
+		log.Fatalf("invalid value for file sample rate")
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	infof("Using seed %v\n", opts.Seed)
+	rand.Seed(opts.Seed)
+
+	if opts.GrpcCompressor != "" && opts.GrpcCompressor != gzip.Name {
+		log.Fatalf("invalid value for grpc compressor: %v", opts.GrpcCompressor)
+	}
+
+	if opts.Benchmark && (opts.DataFilesPath == "" || opts.Estimate) {
+		log.Fatalf("benchmark requires -d and cannot be combined with -estimate")
+	}
+	if opts.BulkExportDir != "" && (opts.Benchmark || opts.Estimate) {
+		log.Fatalf("bulk export cannot be combined with -benchmark or -estimate")
+	}
+
+	if opts.TopMentions > 0 {
+		mentions = newTopKCounter(opts.TopMentions)
+	}
+
+	if opts.NumCommitters <= 0 {
+		opts.NumCommitters = opts.NumClients
+	}
+
+	createdAtLayouts = newLayoutParser(layouts)
+
+	if *timeIndex != "" {
+		pred := opts.Mapping.predicate("created_at")
+		if _, ok := indexes[pred]; ok {
+			log.Fatalf("-time_index cannot be combined with -index for %v", pred)
+		}
+		indexes[pred] = []string{*timeIndex}
+		if *timeIndex == "none" {
+			indexes[pred] = nil
+		}
+	}
+
+	schema, err := buildSchema(opts.Mapping, indexes)
+	checkFatal(err, "invalid index configuration")
+	opts.Schema = schema
+	opts.Predicates, err = intendedPredicates(opts.Mapping, indexes)
+	checkFatal(err, "invalid index configuration")
+
+	if marshal, ok := jsonEncoders[opts.JSONEncoder]; ok {
+		jsonMarshal = marshal
+	} else {
+		log.Fatalf("invalid value for json encoder: %v", opts.JSONEncoder)
+	}
+
+	if opts.DeadLetterPath != "" {
+		deadLetters = newDeadLetterWriter(opts.DeadLetterPath)
+	}
+	if opts.StatsCSVPath != "" {
+		statsCSV = newCSVStatsWriter(opts.StatsCSVPath)
+	}
+	if opts.StatsdAddr != "" {
+		statsd = newStatsdEmitter(opts.StatsdAddr)
+	}
+
+	if opts.PprofAddr != "" {
+		go func() {
+			infof("Serving pprof on %v\n", opts.PprofAddr)
+			errorf("pprof server stopped: %v\n", http.ListenAndServe(opts.PprofAddr, nil))
+		}()
+	}
+
+	if opts.FreshnessProbes > 0 {
+		runFreshnessCheck(opts.FreshnessProbes)
+		return
+	}
+
+	switch {
+	case opts.SynthRate > 0:
+		tweetChannel = setupChannelFromSynth(opts.SynthRate, opts.SynthUsers)
+	case opts.Source == "mastodon":
+		tweetChannel = setupChannelFromMastodon(opts.MastodonURL, opts.MastodonToken)
+	case opts.DataFilesPath == "" && len(opts.FilteredStreams) > 0:
+		var stop func()
+		tweetChannel, stop = setupChannelFromFilteredStreams(opts.FilteredStreams)
+		defer stop()
+	case opts.DataFilesPath == "":
+		creds := readCredentials(opts.CredentialsFile)
+		client := newTwitterClient(creds)
+		stream := client.PublicStreamSample(nil)
+		tweetChannel = pipeStream(stream.C)
+		defer stream.Stop()
+	case opts.DataFilesPath == "-":
+		tweetChannel = setupChannelFromStdin()
+	case isURL(opts.DataFilesPath):
+		tweetChannel = setupChannelFromURL(opts.DataFilesPath)
+	default:
+		tweetChannel = setupChannelFromDir(opts.DataFilesPath)
+	}
+
+	var c *y.Closer
+	switch {
+	case opts.Estimate:
+		c = startEstimators(tweetChannel)
+	case opts.BulkExportDir != "":
+		c = startExporters(tweetChannel)
+	default:
+		c = startInserters(tweetChannel)
+	}
+
+	// report stats
+	r := y.NewCloser(1)
+	go reportStats(r)
+
+	start := time.Now()
+	if opts.Benchmark {
+		infof("Running benchmark for %v after a warmup of %v\n", opts.Duration, opts.Warmup)
+		if opts.Warmup > 0 {
+			warmup.start(opts.Warmup)
+		}
+		time.AfterFunc(opts.Warmup+opts.Duration, c.Signal)
+	}
+	go handleShutdown(c)
+	go handlePause()
+	if opts.LiveSchemaPath != "" && !opts.Estimate {
+		go handleSchemaReload(opts.LiveSchemaPath)
+	}
+
+	c.Wait()
+	r.SignalAndWait()
+	deadLetters.close()
+	statsCSV.close()
+	bulkExport.close()
+	jsonErrors.report()
+	createdAtLayouts.report()
+	if opts.Benchmark {
+		reportBenchmark(time.Since(start))
+	} else {
+		reportSummary(time.Since(start))
+	}
+	if opts.FailOnErrors && !runHealthy(snapshotStats()) {
+		os.Exit(1)
+	}
+	infof("Stopping stream...\n")
+}
+
+func startInserters(tweetChannel chan interface{}) *y.Closer {
+	var pools []*alphaPool
+	for _, cluster := range opts.Clusters {
+		// every connection is dialed separately, the pool spreads the committers over them
+		var addrs []string
+		for _, addr := range cluster.Addrs {
+			for i := 0; i < opts.ConnsPerAlpha; i++ {
+				addrs = append(addrs, addr)
+			}
+		}
+		alphas := newAPIClients(addrs)
+
+		// setup schema, on a dedicated alpha if one is given to keep it off the hot nodes
+		schemaAlphas := alphas
+		if opts.SchemaAlpha != "" {
+			schemaAlphas = newAPIClients([]string{opts.SchemaAlpha})
+			infof("Altering schema on %v\n", opts.SchemaAlpha)
+		}
+		schemaDgr := dgo.NewDgraphClient(schemaAlphas...)
+		if opts.CheckSchema {
+			checkSchema(schemaDgr, cluster.Name)
+		}
+		alterSchema(schemaDgr)
+		liveSchema.dgrs = append(liveSchema.dgrs, schemaDgr)
+
+		pools = append(pools, newAlphaPool(cluster.Name, addrs, alphas))
+	}
+	clusterPools = pools
+
+	infof("Using %v readers and %v committers on %v alphas in %v clusters, "+
+		"%v connections per alpha\n", opts.NumClients, opts.NumCommitters,
+		len(opts.AlphaSockAddr), len(pools), opts.ConnsPerAlpha)
+
+	// read twitter stream
+	upserts := make(chan *upsert, opts.ChanSize)
+	upsertChannel = upserts
+	c := y.NewCloser(0)
+
+	var readers sync.WaitGroup
+	for i := 0; i < opts.NumClients; i++ {
+		c.AddRunning(1)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			supervise(c, "reader", func(work *interface{}) {
+				runReader(c, tweetChannel, upserts, work)
+			})
+		}()
+	}
+	go func() {
+		readers.Wait()
+		close(upserts)
+	}()
+
+	for i := 0; i < opts.NumCommitters; i++ {
+		c.AddRunning(1)
+		go supervise(c, "committer", func(work *interface{}) {
+			runCommitter(pools, upserts, work)
+		})
+	}
+
+	return c
+}
+
+// checkSchema exits before altering the schema if the cluster already has predicates
+// whose type, index or directives differ from the intended ones, listing them all.
+func checkSchema(dgr *dgo.Dgraph, cluster string) {
+	mismatches, err := schemaMismatches(dgr, opts.Predicates)
+	checkFatal(err, "error in fetching the schema of cluster %v", cluster)
+	if len(mismatches) == 0 {
+		infof("Schema of cluster %v matches the intended one\n", cluster)
+		return
+	}
+
+	for _, m := range mismatches {
+		errorf("Schema mismatch in cluster %v: %v\n", cluster, m)
+	}
+	log.Fatalf("found %d schema mismatches in cluster %v, not altering it", len(mismatches), cluster)
+}
+
+// alterSchema sets the schema, ingestion only starts once it succeeds. It gives up after
+// 3 attempts, unless -alter_forever is set, in which case it retries with backoff.
+func alterSchema(dgr *dgo.Dgraph) {
+	op := &api.Operation{
+		Schema: opts.Schema,
+	}
+	retryCount := 0
+	delay := time.Second
+	for {
+		err := dgr.Alter(context.Background(), op)
+		if err == nil {
+			break
+		}
+
+		retryCount++
+		if retryCount == 3 && !opts.AlterForever {
+			checkFatal(err, "error in creating indexes")
+		}
+
+		warnf("sleeping for %v, alter failed %d times: %v\n", delay, retryCount, err)
+		time.Sleep(delay)
+		if opts.AlterForever && delay < cMaxAlterBackoff {
+			delay *= 2
+			if delay > cMaxAlterBackoff {
+				delay = cMaxAlterBackoff
+			}
+		}
+	}
+}
+
+func startEstimators(tweetChannel chan interface{}) *y.Closer {
+	infof("Estimating distinct users and tweets using %v goroutines\n", opts.NumClients)
+
+	c := y.NewCloser(0)
+	for i := 0; i < opts.NumClients; i++ {
+		c.AddRunning(1)
+		go supervise(c, "estimator", func(work *interface{}) {
+			runEstimator(c, tweetChannel, work)
+		})
+	}
+
+	return c
+}
+
+func setupChannelFromDir(dataPath string) chan interface{} {
+	info, err := os.Stat(dataPath)
+	checkFatal(err, "error in opening path to json files")
+
+	var files []string
+	switch {
+	case info.IsDir():
+		// handle directory case
+		err := filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			files = append(files, path)
+			return nil
+		})
+
+		checkFatal(err, "error in walking input data directory")
+	default:
+		// handle single file
+		files = append(files, dataPath)
+	}
+
+	if opts.FileSampleRate < 1 {
+		files = sampleFiles(files, opts.FileSampleRate)
+	}
+
+	// Files are read concurrently by -read_workers goroutines, the tweets of different
+	// files are interleaved since the order in which they are inserted doesn't matter.
+	fileChan := make(chan string, len(files))
+	for _, dataFile := range files {
+		fileChan <- dataFile
+	}
+	close(fileChan)
+
+	dataChan := newTweetChannel()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.ReadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for dataFile := range fileChan {
+				infof("reading file: %v\n", dataFile)
+
+				fd, err := os.Open(dataFile)
+				if err != nil {
+					checkFatal(err, "error in opening file: %v", dataFile)
+				}
+
+				err = scanTweets(dataFile, fd, dataChan)
+				checkFatal(err, "error in scanning file: %v", dataFile)
+				fd.Close()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(dataChan)
+	}()
+
+	return dataChan
+}
+
+// sampleFiles randomly selects the given fraction of files, at least one file is
+// always selected. The selection only depends on the files and -seed.
+func sampleFiles(files []string, rate float64) []string {
+	r := rand.New(rand.NewSource(opts.Seed))
+
+	var sampled []string
+	for _, file := range files {
+		if r.Float64() < rate {
+			sampled = append(sampled, file)
+		}
+	}
+	if len(sampled) == 0 && len(files) > 0 {
+		sampled = append(sampled, files[r.Intn(len(files))])
+	}
+
+	infof("Sampled %d of %d files\n", len(sampled), len(files))
+	return sampled
+}
+
+// newTweetChannel returns the buffered channel a source feeds tweets into.
+func newTweetChannel() chan interface{} {
+	return make(chan interface{}, opts.ChanSize)
+}
+
+// pipeStream forwards the tweets from a stream into a buffered tweet channel.
+func pipeStream(stream <-chan interface{}) chan interface{} {
+	dataChan := newTweetChannel()
+	go func() {
+		for t := range stream {
+			dataChan <- t
+		}
+		close(dataChan)
+	}()
+
+	return dataChan
+}
+
+// setupChannelFromStdin reads tweets from stdin, one JSON tweet per line,
+// until EOF is reached.
+func setupChannelFromStdin() chan interface{} {
+	dataChan := newTweetChannel()
+	go func() {
+		infof("reading tweets from stdin\n")
+
+		err := scanTweets("stdin", os.Stdin, dataChan)
+		checkFatal(err, "error in scanning stdin")
+
+		close(dataChan)
+	}()
+
+	return dataChan
+}
+
+// scanTweets reads tweets from r, one JSON tweet per line or a single JSON array of
+// tweets, and sends them on dataChan.
+func scanTweets(source string, r io.Reader, dataChan chan<- interface{}) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+
+		_ = br.UnreadByte()
+		if b == '[' {
+			scanTweetArray(source, br, dataChan)
+			return nil
+		}
+		break
+	}
+
+	scanner := bufio.NewScanner(br)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		var t anaconda.Tweet
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			atomic.AddUint32(&stats.ErrorsJSON, 1)
+			jsonErrors.record(fmt.Sprintf("%s:%d", source, lineNum), scanner.Bytes(), err)
+			continue
+		}
+
+		dataChan <- t
+	}
+
+	return scanner.Err()
+}
+
+// scanTweetArray streams the elements of a JSON array of tweets. Elements that are not
+// tweets are counted as JSON errors, a malformed array abandons the rest of the source.
+func scanTweetArray(source string, r io.Reader, dataChan chan<- interface{}) {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		abandonTweetArray(source, 0, err)
+		return
+	}
+
+	num := 0
+	for dec.More() {
+		num++
+		var t anaconda.Tweet
+		err := dec.Decode(&t)
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			// the element was read entirely, the array can still be read past it
+			atomic.AddUint32(&stats.ErrorsJSON, 1)
+			jsonErrors.record(fmt.Sprintf("%s[%d]", source, num-1), nil, err)
+			continue
+		}
+		if err != nil {
+			abandonTweetArray(source, num-1, err)
+			return
+		}
+
+		dataChan <- t
+	}
+
+	if _, err := dec.Token(); err != nil {
+		abandonTweetArray(source, num, err)
+	}
+}
+
+func abandonTweetArray(source string, num int, err error) {
+	atomic.AddUint32(&stats.ErrorsJSON, 1)
+	jsonErrors.record(fmt.Sprintf("%s[%d]", source, num), nil, err)
+	errorf("Malformed JSON array in %v, read %d elements before: %v\n", source, num, err)
 }
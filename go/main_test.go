@@ -0,0 +1,606 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/dgraph-io/badger/y"
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const tweetFixture = `{
+	"id_str": "1001",
+	"created_at": "Mon Jan 02 15:04:05 +0000 2006",
+	"full_text": "hello @bob #golang",
+	"entities": {
+		"hashtags": [{"text": "golang", "indices": [12, 19]}],
+		"user_mentions": [{"id_str": "22", "name": "Bob", "screen_name": "bob", "indices": [6, 10]}]
+	},
+	"user": {"id_str": "11", "name": "Alice", "screen_name": "alice", "followers_count": 5}
+}`
+
+// runPipeline pushes the tweets through a reader and a committer against the mock.
+func runPipeline(t *testing.T, m *mockDgraph, msgs ...interface{}) {
+	t.Helper()
+
+	tweets := make(chan interface{}, len(msgs))
+	for _, msg := range msgs {
+		tweets <- msg
+	}
+	close(tweets)
+
+	var work interface{}
+	upserts := make(chan *upsert, len(msgs))
+	runReader(y.NewCloser(0), tweets, upserts, &work)
+	close(upserts)
+	runCommitter([]*alphaPool{mockPool(m)}, upserts, &work)
+}
+
+func TestNewUpsert(t *testing.T) {
+	resetGlobals()
+
+	u := newUpsert(parseTweet(t, tweetFixture))
+	if u == nil {
+		t.Fatalf("tweet was dropped, stats: %+v", stats)
+	}
+
+	for _, block := range []string{
+		`query q($m0: string, $t: string, $u: string)`,
+		`t as var(func: eq(id_str, $t))`,
+		`u as var(func: eq(user_id, $u))`,
+		`m0 as var(func: eq(user_id, $m0))`,
+	} {
+		if !strings.Contains(u.query, block) {
+			t.Errorf("query is missing %q: %s", block, u.query)
+		}
+	}
+	wantVars := map[string]string{"$t": "1001", "$u": "11", "$m0": "22"}
+	if !reflect.DeepEqual(u.vars, wantVars) {
+		t.Errorf("expected vars %v, got %v", wantVars, u.vars)
+	}
+
+	var mutation struct {
+		UID      string   `json:"uid"`
+		IDStr    string   `json:"id_str"`
+		Message  string   `json:"message"`
+		HashTags []string `json:"hashtags"`
+		Author   struct {
+			UID      string `json:"uid"`
+			UserID   string `json:"user_id"`
+			UserName string `json:"user_name"`
+		} `json:"author"`
+		Mention []struct {
+			UID        string `json:"uid"`
+			ScreenName string `json:"screen_name"`
+		} `json:"mention"`
+	}
+	if err := json.Unmarshal(u.mutation.SetJson, &mutation); err != nil {
+		t.Fatalf("invalid mutation: %v", err)
+	}
+
+	if mutation.UID != "uid(t)" || mutation.IDStr != "1001" || mutation.Message != "hello @bob #golang" {
+		t.Errorf("unexpected tweet in mutation: %s", u.mutation.SetJson)
+	}
+	if len(mutation.HashTags) != 1 || mutation.HashTags[0] != "golang" {
+		t.Errorf("unexpected hashtags in mutation: %v", mutation.HashTags)
+	}
+	if mutation.Author.UID != "uid(u)" || mutation.Author.UserName != "Alice" {
+		t.Errorf("unexpected author in mutation: %+v", mutation.Author)
+	}
+	if len(mutation.Mention) != 1 || mutation.Mention[0].UID != "uid(m0)" ||
+		mutation.Mention[0].ScreenName != "bob" {
+		t.Errorf("unexpected mentions in mutation: %+v", mutation.Mention)
+	}
+	if stats.Tweets != 1 || stats.ErrorsJSON != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestNewUpsertFiltered(t *testing.T) {
+	resetGlobals()
+	opts.MinFollowers = 10
+
+	if u := newUpsert(parseTweet(t, tweetFixture)); u != nil {
+		t.Errorf("expected the tweet to be filtered, got query %s", u.query)
+	}
+	if stats.Tweets != 1 || stats.SmallAuthors != 1 || stats.ErrorsJSON != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestNewUpsertInvalidDate(t *testing.T) {
+	resetGlobals()
+
+	tweet := parseTweet(t, tweetFixture)
+	tweet.CreatedAt = "yesterday"
+	if u := newUpsert(tweet); u != nil {
+		t.Errorf("expected the tweet to be rejected, got query %s", u.query)
+	}
+	if stats.Tweets != 1 || stats.ErrorsJSON != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPipelineCommits(t *testing.T) {
+	resetGlobals()
+
+	m := &mockDgraph{}
+	runPipeline(t, m, parseTweet(t, tweetFixture),
+		anaconda.StatusDeletionNotice{IdStr: "1000"})
+
+	if len(m.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(m.requests))
+	}
+	for _, req := range m.requests {
+		if !req.CommitNow || len(req.Mutations) != 1 {
+			t.Errorf("expected a single mutation committed now, got %+v", req)
+		}
+	}
+	if !strings.Contains(m.requests[0].Query, `eq(id_str, $t)`) ||
+		m.requests[0].Vars["$t"] != "1001" {
+		t.Errorf("unexpected upsert query: %s, vars: %v", m.requests[0].Query, m.requests[0].Vars)
+	}
+	if m.requests[1].Vars["$t"] != "1000" {
+		t.Errorf("unexpected deletion vars: %v", m.requests[1].Vars)
+	}
+	if string(m.requests[1].Mutations[0].DelNquads) != `uid(t) * * .` {
+		t.Errorf("unexpected deletion: %+v", m.requests[1].Mutations[0])
+	}
+	if stats.Tweets != 1 || stats.Commits != 1 || stats.Deletes != 1 || stats.ErrorsDgraph != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPipelineSkipsExisting(t *testing.T) {
+	resetGlobals()
+	opts.InsertOnly = true
+
+	m := &mockDgraph{respond: func(req *api.Request) (*api.Response, error) {
+		return &api.Response{Json: []byte(`{"existing": [{"uid": "0x1"}]}`)}, nil
+	}}
+	runPipeline(t, m, parseTweet(t, tweetFixture))
+
+	if len(m.requests) != 1 || m.requests[0].Mutations[0].Cond != "@if(eq(len(t), 0))" {
+		t.Fatalf("expected a single conditional upsert, got %+v", m.requests)
+	}
+	if stats.Skipped != 1 || stats.Commits != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPipelineCountsErrors(t *testing.T) {
+	resetGlobals()
+
+	m := &mockDgraph{respond: func(req *api.Request) (*api.Response, error) {
+		return nil, errors.New("predicate not indexed")
+	}}
+	runPipeline(t, m, parseTweet(t, tweetFixture))
+
+	if stats.ErrorsDgraph != 1 || stats.Commits != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPipelineRetriesOverloaded(t *testing.T) {
+	resetGlobals()
+
+	overloaded := true
+	m := &mockDgraph{respond: func(req *api.Request) (*api.Response, error) {
+		if overloaded {
+			overloaded = false
+			return nil, status.Error(codes.ResourceExhausted, "too many requests")
+		}
+		return &api.Response{Json: []byte(`{}`)}, nil
+	}}
+	runPipeline(t, m, parseTweet(t, tweetFixture))
+
+	if len(m.requests) != 2 || stats.Overloaded != 1 || stats.Commits != 1 {
+		t.Errorf("expected the overloaded upsert to be committed on retry, got %d requests, "+
+			"stats: %+v", len(m.requests), stats)
+	}
+}
+
+func TestPipelineDeadLetters(t *testing.T) {
+	for _, reason := range []string{
+		"predicate not indexed",
+		"connection refused",
+		"Transaction has already been committed or discarded",
+	} {
+		resetGlobals()
+
+		dir, err := ioutil.TempDir("", "flock")
+		if err != nil {
+			t.Fatalf("unable to create a temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "dead.json")
+		deadLetters = newDeadLetterWriter(path)
+
+		m := &mockDgraph{respond: func(req *api.Request) (*api.Response, error) {
+			return nil, errors.New(reason)
+		}}
+		runPipeline(t, m, parseTweet(t, tweetFixture))
+		deadLetters.close()
+		deadLetters = nil
+
+		jsn, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unable to read the dead letters: %v", err)
+		}
+		var letter struct {
+			Reason string `json:"reason"`
+			Tweet  struct {
+				IDStr string `json:"id_str"`
+			} `json:"tweet"`
+		}
+		if err := json.Unmarshal(jsn, &letter); err != nil {
+			t.Fatalf("%s: expected a single dead letter, got %q: %v", reason, jsn, err)
+		}
+		if letter.Reason != reason || letter.Tweet.IDStr != "1001" {
+			t.Errorf("%s: unexpected dead letter: %s", reason, jsn)
+		}
+	}
+}
+
+func TestPipelineBatches(t *testing.T) {
+	resetGlobals()
+	opts.MutationsPerTxn = 2
+
+	second := parseTweet(t, tweetFixture)
+	second.IdStr = "1002"
+
+	m := &mockDgraph{}
+	runPipeline(t, m, parseTweet(t, tweetFixture), second)
+
+	if len(m.requests) != 2 || m.commits != 1 {
+		t.Fatalf("expected 2 upserts in 1 transaction, got %d requests and %d commits",
+			len(m.requests), m.commits)
+	}
+	for _, req := range m.requests {
+		if req.CommitNow {
+			t.Errorf("expected the upserts of a batch not to commit on their own")
+		}
+	}
+	if stats.Commits != 2 || stats.SizeCommits != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBuildQueryRepeatedMention(t *testing.T) {
+	resetGlobals()
+
+	tweet := parseTweet(t, tweetFixture)
+	tweet.Entities.User_mentions = append(tweet.Entities.User_mentions,
+		tweet.Entities.User_mentions[0])
+	u := newUpsert(tweet)
+	if u == nil {
+		t.Fatalf("tweet was dropped, stats: %+v", stats)
+	}
+
+	// the same account can also be repeated past filterTweet, e.g. by synthetic tweets
+	ft := &twitterTweet{
+		IDStr:  "1002",
+		Author: twitterUser{UserID: "11"},
+		Mention: []twitterUser{
+			{UserID: "22", ScreenName: "bob"},
+			{UserID: "22", ScreenName: "bob"},
+		},
+	}
+	query, _ := buildQuery(ft)
+
+	for _, q := range []string{u.query, query} {
+		if n := strings.Count(q, "m0 as var("); n != 1 {
+			t.Errorf("expected a single m0 block, got %d: %s", n, q)
+		}
+		if strings.Contains(q, "m1") {
+			t.Errorf("expected no m1 block: %s", q)
+		}
+	}
+
+	var mutation struct {
+		Mention []struct {
+			UID string `json:"uid"`
+		} `json:"mention"`
+	}
+	if err := json.Unmarshal(u.mutation.SetJson, &mutation); err != nil {
+		t.Fatalf("invalid mutation: %v", err)
+	}
+	if len(mutation.Mention) != 1 || mutation.Mention[0].UID != "uid(m0)" {
+		t.Errorf("expected a single mention edge, got %+v", mutation.Mention)
+	}
+	if len(ft.Mention) != 1 || ft.Mention[0].UID != "uid(m0)" {
+		t.Errorf("expected a single mention edge, got %+v", ft.Mention)
+	}
+}
+
+func TestBuildQueryMergesUsers(t *testing.T) {
+	resetGlobals()
+
+	followers := func(n int) *int { return &n }
+	cases := []struct {
+		name        string
+		author      twitterUser
+		mention     []twitterUser
+		replyToUser *twitterUser
+
+		// the expected records, only the first observation of a user keeps its profile
+		wantAuthor      twitterUser
+		wantMention     []twitterUser
+		wantReplyToUser *twitterUser
+	}{
+		{
+			name:   "author wins over a mention of the author",
+			author: twitterUser{UserID: "11", UserName: "Alice", ScreenName: "alice"},
+			mention: []twitterUser{
+				{UserID: "11", UserName: "Alice M", ScreenName: "alice_m", FollowersCount: followers(3)},
+			},
+			wantAuthor: twitterUser{UID: "uid(u)", UserID: "11", UserName: "Alice",
+				ScreenName: "alice", FollowersCount: followers(3)},
+			wantMention: []twitterUser{{UID: "uid(u)", UserID: "11"}},
+		},
+		{
+			name:   "first mention wins over a repeated mention",
+			author: twitterUser{UserID: "11", UserName: "Alice"},
+			mention: []twitterUser{
+				{UserID: "22", ScreenName: "bob"},
+				{UserID: "22", UserName: "Bob", ScreenName: "bobby"},
+			},
+			wantAuthor: twitterUser{UID: "uid(u)", UserID: "11", UserName: "Alice"},
+			wantMention: []twitterUser{
+				{UID: "uid(m0)", UserID: "22", UserName: "Bob", ScreenName: "bob"},
+			},
+		},
+		{
+			name:        "author wins over the user replied to",
+			author:      twitterUser{UserID: "11", UserName: "Alice"},
+			replyToUser: &twitterUser{UserID: "11", UserName: "Alice R", ScreenName: "alice"},
+			wantAuthor: twitterUser{UID: "uid(u)", UserID: "11", UserName: "Alice",
+				ScreenName: "alice"},
+			wantReplyToUser: &twitterUser{UID: "uid(u)", UserID: "11"},
+		},
+		{
+			name:        "mention wins over the user replied to",
+			author:      twitterUser{UserID: "11", UserName: "Alice"},
+			mention:     []twitterUser{{UserID: "22", ScreenName: "bob"}},
+			replyToUser: &twitterUser{UserID: "22", UserName: "Bob", ScreenName: "bobby"},
+			wantAuthor:  twitterUser{UID: "uid(u)", UserID: "11", UserName: "Alice"},
+			wantMention: []twitterUser{
+				{UID: "uid(m0)", UserID: "22", UserName: "Bob", ScreenName: "bob"},
+			},
+			wantReplyToUser: &twitterUser{UID: "uid(m0)", UserID: "22"},
+		},
+	}
+
+	for _, c := range cases {
+		tweet := &twitterTweet{
+			IDStr:       "1001",
+			Author:      c.author,
+			Mention:     c.mention,
+			ReplyToUser: c.replyToUser,
+		}
+		buildQuery(tweet)
+
+		if !reflect.DeepEqual(tweet.Author, c.wantAuthor) {
+			t.Errorf("%s: expected author %+v, got %+v", c.name, c.wantAuthor, tweet.Author)
+		}
+		if len(tweet.Mention) != len(c.wantMention) ||
+			(len(c.wantMention) > 0 && !reflect.DeepEqual(tweet.Mention, c.wantMention)) {
+			t.Errorf("%s: expected mentions %+v, got %+v", c.name, c.wantMention, tweet.Mention)
+		}
+		if !reflect.DeepEqual(tweet.ReplyToUser, c.wantReplyToUser) {
+			t.Errorf("%s: expected user replied to %+v, got %+v", c.name, c.wantReplyToUser,
+				tweet.ReplyToUser)
+		}
+	}
+}
+
+const truncatedTweetFixture = `{
+	"id_str": "1003",
+	"created_at": "Mon Jan 02 15:04:05 +0000 2006",
+	"truncated": true,
+	"text": "a long tweet that is cut… https://t.co/abc",
+	"entities": {
+		"hashtags": [],
+		"user_mentions": [],
+		"urls": [{"expanded_url": "https://twitter.com/i/web/status/1003", "indices": [27, 42]}]
+	},
+	"extended_tweet": {
+		"full_text": "a long tweet that is cut here by @bob about #golang",
+		"entities": {
+			"hashtags": [{"text": "golang", "indices": [44, 51]}],
+			"user_mentions": [{"id_str": "22", "name": "Bob", "screen_name": "bob", "indices": [33, 37]}],
+			"urls": []
+		}
+	},
+	"user": {"id_str": "11", "name": "Alice", "screen_name": "alice"}
+}`
+
+func TestFilterTweetTruncated(t *testing.T) {
+	resetGlobals()
+	opts.EntityIndices = true
+
+	ft, err := filterTweet(parseTweet(t, truncatedTweetFixture))
+	if err != nil {
+		t.Fatalf("unable to filter tweet: %v", err)
+	}
+
+	if ft.Message != "a long tweet that is cut here by @bob about #golang" {
+		t.Errorf("expected the full text of the extended tweet, got %q", ft.Message)
+	}
+	if len(ft.HashTags) != 1 || ft.HashTags[0] != "golang" {
+		t.Errorf("expected the hashtags of the extended tweet, got %v", ft.HashTags)
+	}
+	if len(ft.Mention) != 1 || ft.Mention[0].ScreenName != "bob" {
+		t.Errorf("expected the mentions of the extended tweet, got %+v", ft.Mention)
+	}
+	for _, url := range ft.URLs {
+		if url != "" {
+			t.Errorf("expected none of the urls of the truncated text, got %v", ft.URLs)
+		}
+	}
+
+	wantEntities := `[{"type":"mention","text":"bob","start":33,"end":37},` +
+		`{"type":"hashtag","text":"golang","start":44,"end":51}]`
+	if ft.Entities != wantEntities {
+		t.Errorf("expected entities %s, got %s", wantEntities, ft.Entities)
+	}
+}
+
+const benchmarkTweetFixture = `{
+	"id_str": "1004",
+	"created_at": "Mon Jan 02 15:04:05 +0000 2006",
+	"full_text": "reading about @bob and @carol on the #golang blog https://t.co/a #gopher #release",
+	"entities": {
+		"hashtags": [{"text": "golang"}, {"text": "gopher"}, {"text": "release"}],
+		"user_mentions": [
+			{"id_str": "22", "name": "Bob", "screen_name": "bob"},
+			{"id_str": "33", "name": "Carol", "screen_name": "carol"}
+		],
+		"urls": [{"expanded_url": "https://go.dev/blog/go1.13"}]
+	},
+	"user": {
+		"id_str": "11",
+		"name": "Alice",
+		"screen_name": "alice",
+		"description": "writes about programming languages, distributed systems and graphs",
+		"friends_count": 120,
+		"followers_count": 3400,
+		"verified": true,
+		"profile_banner_url": "https://pbs.twimg.com/profile_banners/11/1",
+		"profile_image_url": "https://pbs.twimg.com/profile_images/1/alice_normal.jpg"
+	}
+}`
+
+// BenchmarkMarshalTweet compares the -json_encoder choices on the mutation of a tweet
+// with mentions, hashtags and a full author profile, as built for an upsert.
+func BenchmarkMarshalTweet(b *testing.B) {
+	resetGlobals()
+
+	var tweet anaconda.Tweet
+	if err := json.Unmarshal([]byte(benchmarkTweetFixture), &tweet); err != nil {
+		b.Fatalf("invalid tweet fixture: %v", err)
+	}
+
+	ft, err := filterTweet(tweet)
+	if err != nil {
+		b.Fatalf("unable to filter tweet: %v", err)
+	}
+	buildQuery(ft)
+
+	for _, name := range []string{"std", "jsoniter"} {
+		marshal := jsonEncoders[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := marshal(ft); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildQueryEscapesValues(t *testing.T) {
+	resetGlobals()
+	opts.HashtagNodes = true
+
+	tag := `go"lang\`
+	ft := &twitterTweet{
+		IDStr:    `1001") { uid } }`,
+		Author:   twitterUser{UserID: `11\`},
+		HashTags: []string{tag},
+	}
+	ft.Tagged = hashtagNodes(ft.HashTags)
+	query, vars := buildQuery(ft)
+
+	if strings.Contains(query, tag) || strings.Contains(query, ft.IDStr) ||
+		strings.Contains(query, ft.Author.UserID) {
+		t.Errorf("expected the values to be passed as vars only: %s", query)
+	}
+	if !strings.Contains(query, `h0 as var(func: eq(tag, $tag0))`) {
+		t.Errorf("query is missing the hashtag block: %s", query)
+	}
+	wantVars := map[string]string{"$t": ft.IDStr, "$u": ft.Author.UserID, "$tag0": tag}
+	if !reflect.DeepEqual(vars, wantVars) {
+		t.Errorf("expected vars %v, got %v", wantVars, vars)
+	}
+}
+
+func TestFilterTweetOptionalFields(t *testing.T) {
+	resetGlobals()
+
+	tweet := parseTweet(t, tweetFixture)
+	tweet.InReplyToStatusIdStr = "1000"
+	tweet.InReplyToUserIdStr = "22"
+	tweet.PossiblySensitive = true
+	tweet.WithheldInCountries = []string{"DE"}
+
+	ft, err := filterTweet(tweet)
+	if err != nil {
+		t.Fatalf("unable to filter tweet: %v", err)
+	}
+	if ft.ReplyTo != nil || ft.ReplyToUser != nil || ft.PossiblySensitive != nil ||
+		ft.WithheldCountries != nil {
+		t.Errorf("expected no optional fields without their flags: %+v", ft)
+	}
+
+	opts.StoreReplies = true
+	opts.StoreSensitive = true
+	opts.StoreWithheld = true
+	ft, err = filterTweet(tweet)
+	if err != nil {
+		t.Fatalf("unable to filter tweet: %v", err)
+	}
+	if ft.ReplyTo == nil || ft.ReplyToUser == nil || ft.PossiblySensitive == nil ||
+		len(ft.WithheldCountries) != 1 {
+		t.Errorf("expected the optional fields with their flags: %+v", ft)
+	}
+}
+
+func TestSuperviseRestartsWithBackoff(t *testing.T) {
+	resetGlobals()
+
+	runs := 0
+	start := time.Now()
+	c := y.NewCloser(1)
+	supervise(c, "test", func(work *interface{}) {
+		runs++
+		*work = runs
+		if runs < 3 {
+			panic("bad tweet")
+		}
+	})
+
+	if runs != 3 || stats.Panics != 2 {
+		t.Errorf("expected 2 restarts, got %d runs, stats: %+v", runs, stats)
+	}
+	if elapsed := time.Since(start); elapsed < 3*cMinRestartDelay {
+		t.Errorf("expected the restarts to back off, took %v", elapsed)
+	}
+}
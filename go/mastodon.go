@@ -0,0 +1,219 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+type mastodonAccount struct {
+	ID             string `json:"id"`
+	Username       string `json:"username"`
+	Acct           string `json:"acct"`
+	DisplayName    string `json:"display_name"`
+	Note           string `json:"note"`
+	FollowersCount int    `json:"followers_count"`
+	FollowingCount int    `json:"following_count"`
+	Avatar         string `json:"avatar"`
+	Header         string `json:"header"`
+}
+
+type mastodonMention struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Acct     string `json:"acct"`
+}
+
+type mastodonTag struct {
+	Name string `json:"name"`
+}
+
+// mastodonStatus is a status as sent by the mastodon streaming API.
+type mastodonStatus struct {
+	ID        string            `json:"id"`
+	CreatedAt string            `json:"created_at"`
+	Content   string            `json:"content"`
+	Account   mastodonAccount   `json:"account"`
+	Mentions  []mastodonMention `json:"mentions"`
+	Tags      []mastodonTag     `json:"tags"`
+	Reblog    *mastodonStatus   `json:"reblog"`
+	Language  string            `json:"language"`
+	Sensitive bool              `json:"sensitive"`
+
+	ReblogsCount    int `json:"reblogs_count"`
+	FavouritesCount int `json:"favourites_count"`
+
+	InReplyToID        string `json:"in_reply_to_id"`
+	InReplyToAccountID string `json:"in_reply_to_account_id"`
+}
+
+// setupChannelFromMastodon streams the public timeline of a mastodon instance,
+// reconnecting whenever the stream is interrupted.
+func setupChannelFromMastodon(instanceURL, token string) chan interface{} {
+	streamURL := strings.TrimRight(instanceURL, "/") + "/api/v1/streaming/public"
+
+	dataChan := newTweetChannel()
+	go func() {
+		for {
+			infof("connecting to mastodon stream: %v\n", streamURL)
+			if err := streamMastodon(streamURL, token, dataChan); err != nil {
+				errorf("mastodon stream interrupted: %v\n", err)
+			}
+
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	return dataChan
+}
+
+// streamMastodon reads server sent events from the stream and sends the statuses
+// carried by update events on dataChan.
+func streamMastodon(streamURL, token string, dataChan chan<- interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, streamURL, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+
+	var event string
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// a blank line terminates the event
+			if event == "update" && data.Len() > 0 {
+				var status mastodonStatus
+				if err := json.Unmarshal(data.Bytes(), &status); err != nil {
+					atomic.AddUint32(&stats.ErrorsJSON, 1)
+					jsonErrors.record("mastodon", data.Bytes(), err)
+				} else {
+					dataChan <- status
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by server")
+}
+
+// filterStatus maps a mastodon status into the same shape as a tweet.
+func filterStatus(status mastodonStatus) (*twitterTweet, error) {
+	createdAt, err := time.Parse(time.RFC3339, status.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// the content of a boost lives in the boosted status
+	content := status.Content
+	if status.Reblog != nil && content == "" {
+		content = status.Reblog.Content
+	}
+
+	hashTagTexts := make([]string, 0, len(status.Tags))
+	for _, tag := range status.Tags {
+		if tag.Name != "" {
+			hashTagTexts = append(hashTagTexts, tag.Name)
+		}
+	}
+
+	var userMentions []twitterUser
+	mentioned := make(map[string]bool)
+	for _, mention := range status.Mentions {
+		if mention.ID == "" || mentioned[mention.ID] {
+			continue
+		}
+
+		mentioned[mention.ID] = true
+		userMentions = append(userMentions, twitterUser{
+			UserID:     mention.ID,
+			DgraphType: opts.Mapping.UserType,
+			UserName:   mention.Username,
+			ScreenName: mention.Acct,
+		})
+	}
+
+	ft := &twitterTweet{
+		IDStr:      status.ID,
+		DgraphType: opts.Mapping.TweetType,
+		CreatedAt:  createdAt.Format(cDgraphTimeFormat),
+		Message:    stripHTML(content),
+		HashTags:   hashTagTexts,
+		Author: twitterUser{
+			UserID:           status.Account.ID,
+			DgraphType:       opts.Mapping.UserType,
+			UserName:         status.Account.DisplayName,
+			ScreenName:       status.Account.Acct,
+			Description:      stripHTML(status.Account.Note),
+			FriendsCount:     intValue(status.Account.FollowingCount),
+			FollowersCount:   intValue(status.Account.FollowersCount),
+			ProfileBannerURL: status.Account.Header,
+			ProfileImageURL:  status.Account.Avatar,
+		},
+		Mention:     userMentions,
+		Retweet:     status.Reblog != nil,
+		ReplyTo:     newReplyTo(status.InReplyToID),
+		ReplyToUser: newReplyToUser(status.InReplyToAccountID, ""),
+
+		PossiblySensitive: boolValue(status.Sensitive),
+	}
+	if opts.StoreEngagement {
+		ft.RetweetCount = intValue(status.ReblogsCount)
+		ft.FavoriteCount = intValue(status.FavouritesCount)
+	}
+
+	return ft, nil
+}
+
+func stripHTML(s string) string {
+	return strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(s, " ")))
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"google.golang.org/grpc"
+)
+
+// mockDgraph is an in-process api.DgraphClient that records the requests it receives and
+// answers them with canned responses, so that the pipeline runs without a cluster.
+type mockDgraph struct {
+	sync.Mutex
+	requests []*api.Request
+	commits  int
+	aborts   int
+
+	// respond answers a request, an empty response is returned if it is nil.
+	respond func(req *api.Request) (*api.Response, error)
+}
+
+func (m *mockDgraph) Login(ctx context.Context, in *api.LoginRequest,
+	opts ...grpc.CallOption) (*api.Response, error) {
+
+	return &api.Response{}, nil
+}
+
+func (m *mockDgraph) Query(ctx context.Context, in *api.Request,
+	opts ...grpc.CallOption) (*api.Response, error) {
+
+	m.Lock()
+	m.requests = append(m.requests, in)
+	respond := m.respond
+	m.Unlock()
+
+	if respond == nil {
+		return &api.Response{Json: []byte(`{}`)}, nil
+	}
+	return respond(in)
+}
+
+func (m *mockDgraph) Alter(ctx context.Context, in *api.Operation,
+	opts ...grpc.CallOption) (*api.Payload, error) {
+
+	return &api.Payload{}, nil
+}
+
+func (m *mockDgraph) CommitOrAbort(ctx context.Context, in *api.TxnContext,
+	opts ...grpc.CallOption) (*api.TxnContext, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if in.Aborted {
+		m.aborts++
+	} else {
+		m.commits++
+	}
+	return in, nil
+}
+
+func (m *mockDgraph) CheckVersion(ctx context.Context, in *api.Check,
+	opts ...grpc.CallOption) (*api.Version, error) {
+
+	return &api.Version{}, nil
+}
+
+// mockPool returns a pool of a single alpha answered by the mock.
+func mockPool(m *mockDgraph) *alphaPool {
+	return newAlphaPool("mock", []string{"mock:9080"}, []api.DgraphClient{m})
+}
+
+// resetGlobals puts the options back to the defaults of the flags and clears the stats,
+// for a test to set what it needs on top.
+func resetGlobals() {
+	opts = progOptions{
+		NumClients:       1,
+		NumCommitters:    1,
+		ReportPeriodSecs: 10,
+		JSONEncoder:      "std",
+		Source:           "twitter",
+		Mapping:          defaultMapping,
+		MutationsPerTxn:  1,
+		ProfilePolicy:    "always",
+		ReadWorkers:      1,
+		ConnsPerAlpha:    1,
+	}
+	stats = progStats{}
+	jsonMarshal = json.Marshal
+	createdAtLayouts = newLayoutParser(nil)
+	mentions = nil
+}
+
+// parseTweet decodes a tweet the way the readers of the stream and the files do.
+func parseTweet(t *testing.T, jsn string) anaconda.Tweet {
+	t.Helper()
+
+	var tweet anaconda.Tweet
+	if err := json.Unmarshal([]byte(jsn), &tweet); err != nil {
+		t.Fatalf("invalid tweet fixture: %v", err)
+	}
+	return tweet
+}
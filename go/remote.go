@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isURL reports whether the -d path is an http(s) URL rather than a local path.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// setupChannelFromURL streams tweets from a file served over http(s), decompressing it
+// on the fly if it is gzipped, without staging it to disk first.
+func setupChannelFromURL(url string) chan interface{} {
+	dataChan := newTweetChannel()
+	go func() {
+		infof("reading tweets from %v\n", url)
+
+		resp, err := http.Get(url)
+		checkFatal(err, "error in downloading file: %v", url)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			checkFatal(fmt.Errorf("unexpected status %v", resp.Status),
+				"error in downloading file: %v", url)
+		}
+
+		r, err := decompress(resp.Body)
+		checkFatal(err, "error in decompressing file: %v", url)
+
+		err = scanTweets(url, r, dataChan)
+		checkFatal(err, "error in scanning file: %v", url)
+
+		close(dataChan)
+	}()
+
+	return dataChan
+}
+
+// decompress returns a reader of the decompressed content of r if it is gzipped, found
+// by its magic number since servers rarely set a Content-Encoding for .gz files.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == io.EOF || (err == nil && (magic[0] != 0x1f || magic[1] != 0x8b)) {
+		return br, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return gzip.NewReader(br)
+}
@@ -0,0 +1,473 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/dgo/v2"
+)
+
+// typeSchema is a dgraph type along with the predicates it is made of.
+type typeSchema struct {
+	Name   string
+	Fields []string
+}
+
+var schemaTypes = []typeSchema{
+	{
+		Name: "Tweet",
+		Fields: []string{"id_str", "created_at", "message", "urls", "hashtags", "author",
+			"mention", "retweet", "source_tag", "tagged", "reply_to", "reply_to_user",
+			"created_at_epoch", "run_id", "mention_names", "retweet_count", "favorite_count",
+			"possibly_sensitive", "withheld_countries", "withheld_scope",
+			"entities"},
+	},
+	{
+		Name: "User",
+		Fields: []string{"user_id", "user_name", "screen_name", "description", "friends_count",
+			"followers_count", "verified", "profile_banner_url", "profile_image_url",
+			"source_tag", "profile_at"},
+	},
+	{
+		Name:   "Hashtag",
+		Fields: []string{"tag"},
+	},
+}
+
+// predicateSchema is the schema of a single predicate.
+type predicateSchema struct {
+	Name       string
+	Type       string
+	Indexes    []string
+	Directives []string
+}
+
+var schemaPredicates = []predicateSchema{
+	{Name: "user_id", Type: "string", Indexes: []string{"exact"}, Directives: []string{"@upsert"}},
+	{Name: "user_name", Type: "string", Indexes: []string{"hash"}},
+	{Name: "screen_name", Type: "string", Indexes: []string{"term"}},
+	{Name: "description", Type: "string"},
+	{Name: "friends_count", Type: "int"},
+	{Name: "followers_count", Type: "int"},
+	{Name: "verified", Type: "bool"},
+	{Name: "profile_banner_url", Type: "string"},
+	{Name: "profile_image_url", Type: "string"},
+	{Name: "profile_at", Type: "dateTime", Indexes: []string{"hour"}},
+	{Name: "id_str", Type: "string", Indexes: []string{"exact"}, Directives: []string{"@upsert"}},
+	{Name: "created_at", Type: "dateTime", Indexes: []string{"hour"}},
+	{Name: "created_at_epoch", Type: "int", Indexes: []string{"int"}},
+	{Name: "run_id", Type: "string", Indexes: []string{"exact"}},
+	{Name: "message", Type: "string"},
+	{Name: "urls", Type: "[string]"},
+	{Name: "hashtags", Type: "[string]", Indexes: []string{"exact"}},
+	{Name: "author", Type: "uid", Directives: []string{"@count", "@reverse"}},
+	{Name: "mention", Type: "[uid]", Directives: []string{"@reverse"}},
+	{Name: "mention_names", Type: "[string]", Indexes: []string{"exact"}},
+	{Name: "retweet", Type: "bool"},
+	{Name: "retweet_count", Type: "int"},
+	{Name: "favorite_count", Type: "int", Indexes: []string{"int"}},
+	{Name: "possibly_sensitive", Type: "bool", Indexes: []string{"bool"}},
+	{Name: "withheld_countries", Type: "[string]", Indexes: []string{"exact"}},
+	{Name: "withheld_scope", Type: "string", Indexes: []string{"exact"}},
+	{Name: "entities", Type: "string"},
+	{Name: "source_tag", Type: "string", Indexes: []string{"exact"}},
+	{Name: "tag", Type: "string", Indexes: []string{"exact"}, Directives: []string{"@upsert"}},
+	{Name: "tagged", Type: "[uid]", Directives: []string{"@count", "@reverse"}},
+	{Name: "reply_to", Type: "uid", Directives: []string{"@count", "@reverse"}},
+	{Name: "reply_to_user", Type: "uid", Directives: []string{"@reverse"}},
+}
+
+// predicateEnabled reports whether flock stores the predicate with the options set. The
+// predicates of optional features are left out of the schema unless their flag is set,
+// so that a run without them doesn't create their predicates and indexes.
+func predicateEnabled(name string) bool {
+	switch name {
+	case "source_tag":
+		return opts.SourceTag != ""
+	case "profile_at":
+		return opts.ProfilePolicy != "always"
+	case "tag", "tagged":
+		return opts.HashtagNodes
+	case "reply_to", "reply_to_user":
+		return opts.StoreReplies
+	case "created_at_epoch":
+		return opts.EpochTimestamp
+	case "run_id":
+		return opts.StoreRunID
+	case "mention_names":
+		return opts.SkipMentionNodes
+	case "retweet_count", "favorite_count":
+		return opts.StoreEngagement
+	case "possibly_sensitive":
+		return opts.StoreSensitive
+	case "withheld_countries", "withheld_scope":
+		return opts.StoreWithheld
+	case "entities":
+		return opts.EntityIndices
+	default:
+		return true
+	}
+}
+
+// validTokenizers lists the index tokenizers dgraph supports for each scalar type.
+var validTokenizers = map[string][]string{
+	"string":   {"exact", "hash", "term", "fulltext", "trigram"},
+	"int":      {"int"},
+	"float":    {"float"},
+	"bool":     {"bool"},
+	"dateTime": {"year", "month", "day", "hour"},
+	"geo":      {"geo"},
+}
+
+// indexOverrides maps a predicate to the tokenizers it should be indexed with,
+// an empty list disables the index. It is set with repeated -index flags.
+type indexOverrides map[string][]string
+
+func (o indexOverrides) String() string {
+	preds := make([]string, 0, len(o))
+	for pred, tokenizers := range o {
+		preds = append(preds, pred+"="+strings.Join(tokenizers, ","))
+	}
+
+	sort.Strings(preds)
+	return strings.Join(preds, " ")
+}
+
+func (o indexOverrides) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected predicate=tokenizer[,tokenizer...], got %q", value)
+	}
+
+	var tokenizers []string
+	for _, tok := range strings.Split(parts[1], ",") {
+		if tok = strings.TrimSpace(tok); tok != "" {
+			tokenizers = append(tokenizers, tok)
+		}
+	}
+
+	o[strings.TrimSpace(parts[0])] = tokenizers
+	return nil
+}
+
+// buildSchema returns the dgraph schema of the predicates enabled by the options, with
+// the data mapping and the index overrides applied. Index overrides refer to predicates
+// by their mapped names. Types without any enabled predicate are left out.
+func buildSchema(mapping dataMapping, overrides indexOverrides) (string, error) {
+	preds, err := intendedPredicates(mapping, overrides)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, typ := range schemaTypes {
+		var fields []string
+		for _, field := range typ.Fields {
+			if predicateEnabled(field) {
+				fields = append(fields, mapping.predicate(field))
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		sb.WriteString("\t\ttype " + mapping.typeName(typ.Name) + " {\n")
+		for _, field := range fields {
+			sb.WriteString("\t\t\t" + field + "\n")
+		}
+		sb.WriteString("\t\t}\n\n")
+	}
+
+	for _, pred := range preds {
+		sb.WriteString("\t\t" + pred.Name + ": " + pred.Type)
+		if len(pred.Indexes) > 0 {
+			sb.WriteString(" @index(" + strings.Join(pred.Indexes, ", ") + ")")
+		}
+		for _, directive := range pred.Directives {
+			sb.WriteString(" " + directive)
+		}
+		sb.WriteString(" .\n")
+	}
+
+	return sb.String(), nil
+}
+
+// intendedPredicates returns the schema of the predicates enabled by the options, with
+// the data mapping and the index overrides applied.
+func intendedPredicates(mapping dataMapping, overrides indexOverrides) ([]predicateSchema, error) {
+	var preds []predicateSchema
+	known := make(map[string]bool)
+	for _, pred := range schemaPredicates {
+		enabled := predicateEnabled(pred.Name)
+		pred.Name = mapping.predicate(pred.Name)
+		known[pred.Name] = true
+		if _, ok := overrides[pred.Name]; ok && !enabled {
+			return nil, fmt.Errorf("index override for %v, which is not stored without its flag",
+				pred.Name)
+		}
+		if !enabled {
+			continue
+		}
+		if tokenizers, ok := overrides[pred.Name]; ok {
+			if err := validateIndex(pred, tokenizers); err != nil {
+				return nil, err
+			}
+			pred.Indexes = tokenizers
+		}
+		preds = append(preds, pred)
+	}
+
+	for pred := range overrides {
+		if !known[pred] {
+			return nil, fmt.Errorf("unknown predicate in index override: %v", pred)
+		}
+	}
+
+	return preds, nil
+}
+
+// existingPredicate is the schema of a predicate as returned by a schema query.
+type existingPredicate struct {
+	Predicate string   `json:"predicate"`
+	Type      string   `json:"type"`
+	List      bool     `json:"list"`
+	Tokenizer []string `json:"tokenizer"`
+	Upsert    bool     `json:"upsert"`
+	Count     bool     `json:"count"`
+	Reverse   bool     `json:"reverse"`
+}
+
+// schemaMismatches fetches the schema of the cluster, and describes every predicate
+// whose type, index or directives differ from the intended ones. Predicates that don't
+// exist yet are not mismatches, the alter creates them.
+func schemaMismatches(dgr *dgo.Dgraph, preds []predicateSchema) ([]string, error) {
+	resp, err := dgr.NewReadOnlyTxn().Query(context.Background(), `schema {}`)
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Schema []existingPredicate `json:"schema"`
+	}
+	if err := json.Unmarshal(resp.Json, &r); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]existingPredicate, len(r.Schema))
+	for _, p := range r.Schema {
+		existing[p.Predicate] = p
+	}
+
+	var mismatches []string
+	for _, pred := range preds {
+		p, ok := existing[pred.Name]
+		if !ok {
+			continue
+		}
+
+		typ := p.Type
+		if p.List {
+			typ = "[" + typ + "]"
+		}
+		// dgraph reports dateTime as datetime
+		if !strings.EqualFold(typ, pred.Type) {
+			mismatches = append(mismatches,
+				fmt.Sprintf("%v has type %v, flock expects %v", pred.Name, typ, pred.Type))
+		}
+
+		have := append([]string(nil), p.Tokenizer...)
+		want := append([]string(nil), pred.Indexes...)
+		sort.Strings(have)
+		sort.Strings(want)
+		if strings.Join(have, ",") != strings.Join(want, ",") {
+			mismatches = append(mismatches, fmt.Sprintf("%v is indexed with [%v], flock expects [%v]",
+				pred.Name, strings.Join(have, ","), strings.Join(want, ",")))
+		}
+
+		for _, d := range []struct {
+			directive string
+			set       bool
+		}{{"@upsert", p.Upsert}, {"@count", p.Count}, {"@reverse", p.Reverse}} {
+			if want := hasDirective(pred, d.directive); want != d.set {
+				mismatches = append(mismatches, fmt.Sprintf("%v has %v: %v, flock expects %v",
+					pred.Name, d.directive, d.set, want))
+			}
+		}
+	}
+
+	return mismatches, nil
+}
+
+func hasDirective(pred predicateSchema, directive string) bool {
+	for _, d := range pred.Directives {
+		if d == directive {
+			return true
+		}
+	}
+	return false
+}
+
+func validateIndex(pred predicateSchema, tokenizers []string) error {
+	if len(tokenizers) == 0 {
+		for _, directive := range pred.Directives {
+			if directive == "@upsert" {
+				return fmt.Errorf("index on %v cannot be disabled, it is used for upserts", pred.Name)
+			}
+		}
+		return nil
+	}
+
+	scalar := strings.Trim(pred.Type, "[]")
+	valid, ok := validTokenizers[scalar]
+	if !ok {
+		return fmt.Errorf("predicate %v of type %v cannot be indexed", pred.Name, pred.Type)
+	}
+
+	for _, tok := range tokenizers {
+		found := false
+		for _, v := range valid {
+			if tok == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("invalid tokenizer %v for predicate %v of type %v, expected one of %v",
+				tok, pred.Name, pred.Type, strings.Join(valid, ", "))
+		}
+	}
+
+	return nil
+}
+
+// dataMapping names the dgraph types and the key predicates that flock writes, so that
+// the upsert machinery can be reused for data with the same shape as tweets.
+type dataMapping struct {
+	TweetType string `json:"tweet_type"`
+	UserType  string `json:"user_type"`
+	TweetKey  string `json:"tweet_key"`
+	UserKey   string `json:"user_key"`
+}
+
+var defaultMapping = dataMapping{
+	TweetType: "Tweet",
+	UserType:  "User",
+	TweetKey:  "id_str",
+	UserKey:   "user_id",
+}
+
+// readMapping reads a data mapping from a JSON file, fields missing from the file
+// keep their default values.
+func readMapping(path string) dataMapping {
+	mapping := defaultMapping
+	if path == "" {
+		return mapping
+	}
+
+	jsn, err := ioutil.ReadFile(path)
+	checkFatal(err, "Unable to open mapping file '%s'", path)
+	err = json.Unmarshal(jsn, &mapping)
+	checkFatal(err, "Unable to parse mapping file '%s'", path)
+
+	for _, name := range []string{mapping.TweetType, mapping.UserType,
+		mapping.TweetKey, mapping.UserKey} {
+		if name == "" || strings.ContainsAny(name, " \t\n<>{}()\"") {
+			checkFatal(fmt.Errorf("invalid name %q", name), "Invalid mapping file '%s'", path)
+		}
+	}
+
+	return mapping
+}
+
+func (m dataMapping) isDefault() bool {
+	return m == defaultMapping
+}
+
+func (m dataMapping) typeName(name string) string {
+	switch name {
+	case defaultMapping.TweetType:
+		return m.TweetType
+	case defaultMapping.UserType:
+		return m.UserType
+	default:
+		return name
+	}
+}
+
+func (m dataMapping) predicate(name string) string {
+	switch name {
+	case defaultMapping.TweetKey:
+		return m.TweetKey
+	case defaultMapping.UserKey:
+		return m.UserKey
+	default:
+		return name
+	}
+}
+
+// renameKeys renames the key predicates in a marshaled mutation to their mapped names.
+// The keys are replaced in the encoded bytes, the values are left as the -json_encoder
+// wrote them, so that numbers keep their precision.
+func (m dataMapping) renameKeys(jsn []byte) []byte {
+	renames := make(map[string][]byte)
+	for _, key := range []string{defaultMapping.TweetKey, defaultMapping.UserKey} {
+		if mapped := m.predicate(key); mapped != key {
+			quoted, _ := json.Marshal(mapped)
+			renames[`"`+key+`"`] = quoted
+		}
+	}
+
+	renamed := make([]byte, 0, len(jsn))
+	for i := 0; i < len(jsn); {
+		if jsn[i] != '"' {
+			renamed = append(renamed, jsn[i])
+			i++
+			continue
+		}
+
+		// quotes within strings are escaped, so this is the end of the string
+		end := i + 1
+		for end < len(jsn) && jsn[end] != '"' {
+			if jsn[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end < len(jsn) {
+			end++
+		}
+
+		// a string followed by a colon is a key
+		str := jsn[i:end]
+		if end < len(jsn) && jsn[end] == ':' {
+			if to, ok := renames[string(str)]; ok {
+				str = to
+			}
+		}
+		renamed = append(renamed, str...)
+		i = end
+	}
+
+	return renamed
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarshalMutationRenamesKeys(t *testing.T) {
+	resetGlobals()
+	opts.Mapping = dataMapping{
+		TweetType: "Post",
+		UserType:  "Person",
+		TweetKey:  "post_id",
+		UserKey:   "person_id",
+	}
+
+	tweet := &twitterTweet{
+		IDStr: "1001",
+		// the keys are left alone within strings
+		Message: `{"id_str": "1", "user_id":"2"} \"user_id\":`,
+		Author:  twitterUser{UserID: "11", ScreenName: "user_id"},
+		Mention: []twitterUser{{UserID: "22"}},
+		// beyond the precision of a float64
+		CreatedAtEpoch: 1<<53 + 1,
+	}
+
+	for name, marshal := range jsonEncoders {
+		jsonMarshal = marshal
+		jsn, err := marshalMutation(tweet)
+		if err != nil {
+			t.Fatalf("%s: unable to marshal mutation: %v", name, err)
+		}
+
+		want, err := marshal(tweet)
+		if err != nil {
+			t.Fatalf("%s: unable to marshal tweet: %v", name, err)
+		}
+		replacer := strings.NewReplacer(`"id_str":`, `"post_id":`, `"user_id":`, `"person_id":`)
+		if string(jsn) != replacer.Replace(string(want)) {
+			t.Errorf("%s: unexpected mutation: %s", name, jsn)
+		}
+		if !strings.Contains(string(jsn), `"created_at_epoch":9007199254740993`) {
+			t.Errorf("%s: expected the epoch to keep its precision: %s", name, jsn)
+		}
+	}
+}
+
+func TestBuildSchemaOptionalPredicates(t *testing.T) {
+	cases := []struct {
+		enable func()
+		preds  []string
+	}{
+		{func() { opts.SourceTag = "archive" }, []string{"source_tag"}},
+		{func() { opts.ProfilePolicy = "newest" }, []string{"profile_at"}},
+		{func() { opts.HashtagNodes = true }, []string{"tag", "tagged"}},
+		{func() { opts.StoreReplies = true }, []string{"reply_to", "reply_to_user"}},
+		{func() { opts.EpochTimestamp = true }, []string{"created_at_epoch"}},
+		{func() { opts.StoreRunID = true }, []string{"run_id"}},
+		{func() { opts.SkipMentionNodes = true }, []string{"mention_names"}},
+		{func() { opts.StoreEngagement = true }, []string{"retweet_count", "favorite_count"}},
+		{func() { opts.StoreSensitive = true }, []string{"possibly_sensitive"}},
+		{func() { opts.StoreWithheld = true }, []string{"withheld_countries", "withheld_scope"}},
+		{func() { opts.EntityIndices = true }, []string{"entities"}},
+	}
+
+	resetGlobals()
+	schema, err := buildSchema(defaultMapping, indexOverrides{})
+	if err != nil {
+		t.Fatalf("unable to build schema: %v", err)
+	}
+	if strings.Contains(schema, "type Hashtag") {
+		t.Errorf("expected no Hashtag type without -hashtag_nodes:\n%s", schema)
+	}
+	for _, c := range cases {
+		for _, pred := range c.preds {
+			if strings.Contains(schema, "\t"+pred+"\n") || strings.Contains(schema, pred+":") {
+				t.Errorf("expected no %v in the default schema:\n%s", pred, schema)
+			}
+		}
+	}
+
+	for _, c := range cases {
+		resetGlobals()
+		c.enable()
+		schema, err := buildSchema(defaultMapping, indexOverrides{})
+		if err != nil {
+			t.Fatalf("unable to build schema: %v", err)
+		}
+		for _, pred := range c.preds {
+			if !strings.Contains(schema, "\t"+pred+"\n") || !strings.Contains(schema, pred+":") {
+				t.Errorf("expected %v in the type and the predicates:\n%s", pred, schema)
+			}
+		}
+	}
+}
+
+func TestIndexOverrideOfDisabledPredicate(t *testing.T) {
+	resetGlobals()
+
+	overrides := indexOverrides{"favorite_count": nil}
+	if _, err := buildSchema(defaultMapping, overrides); err == nil {
+		t.Errorf("expected an error for an override of a predicate that isn't stored")
+	}
+
+	opts.StoreEngagement = true
+	schema, err := buildSchema(defaultMapping, overrides)
+	if err != nil {
+		t.Fatalf("unable to build schema: %v", err)
+	}
+	if !strings.Contains(schema, "favorite_count: int .\n") {
+		t.Errorf("expected favorite_count without an index:\n%s", schema)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// statsCSV is nil unless -stats_csv is set.
+var statsCSV *csvStatsWriter
+
+// csvStatsWriter appends the stats of every reporting interval as a row of a CSV file.
+// The columns are the timestamp followed by the fields of progStats, counted over the
+// interval, so that the rows of several runs can be appended to the same file.
+type csvStatsWriter struct {
+	fd *os.File
+	w  *csv.Writer
+}
+
+func newCSVStatsWriter(path string) *csvStatsWriter {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	checkFatal(err, "error in opening stats csv file: %v", path)
+	info, err := fd.Stat()
+	checkFatal(err, "error in reading stats csv file: %v", path)
+
+	c := &csvStatsWriter{fd: fd, w: csv.NewWriter(fd)}
+	if info.Size() > 0 {
+		// the header was written by an earlier run
+		return c
+	}
+
+	header := []string{"time"}
+	typ := reflect.TypeOf(progStats{})
+	for i := 0; i < typ.NumField(); i++ {
+		header = append(header, typ.Field(i).Name)
+	}
+	c.writeRow(header)
+
+	return c
+}
+
+func (c *csvStatsWriter) write(s progStats) {
+	if c == nil {
+		return
+	}
+
+	row := []string{time.Now().Format(time.RFC3339)}
+	val := reflect.ValueOf(s)
+	for i := 0; i < val.NumField(); i++ {
+		row = append(row, strconv.FormatUint(val.Field(i).Uint(), 10))
+	}
+	c.writeRow(row)
+}
+
+func (c *csvStatsWriter) writeRow(row []string) {
+	if err := c.w.Write(row); err != nil {
+		errorf("Unable to write stats csv: %v\n", err)
+		return
+	}
+
+	// flush every row so that the file can be charted while flock runs
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		errorf("Unable to write stats csv: %v\n", err)
+	}
+}
+
+func (c *csvStatsWriter) close() {
+	if c == nil {
+		return
+	}
+
+	checkFatal(c.fd.Close(), "error in closing stats csv file")
+}
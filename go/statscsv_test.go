@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSVStatsAppendsAcrossRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flock")
+	if err != nil {
+		t.Fatalf("unable to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.csv")
+
+	for run := 1; run <= 2; run++ {
+		w := newCSVStatsWriter(path)
+		w.write(progStats{Tweets: 10 * uint32(run), Commits: 5}.since(progStats{Commits: 5}))
+		w.close()
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open the stats: %v", err)
+	}
+	defer fd.Close()
+	rows, err := csv.NewReader(fd).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid stats csv: %v", err)
+	}
+
+	if len(rows) != 3 || rows[0][0] != "time" || rows[0][1] != "Tweets" {
+		t.Fatalf("expected a header and a row per run, got %v", rows)
+	}
+	for i, row := range rows[1:] {
+		if row[1] != []string{"10", "20"}[i] || row[2] != "0" {
+			t.Errorf("unexpected row %d: %v", i+1, row)
+		}
+	}
+}
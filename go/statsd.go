@@ -0,0 +1,86 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"unicode"
+)
+
+// cStatsdPrefix is prepended to the name of every metric sent to statsd.
+const cStatsdPrefix = "flock."
+
+// statsd is nil unless -statsd_addr is set.
+var statsd *statsdEmitter
+
+// statsdEmitter sends the stats of every reporting interval to statsd over UDP. The
+// fields of progStats are sent as counters of their increase over the interval, and
+// the queue lengths as gauges.
+type statsdEmitter struct {
+	conn  net.Conn
+	names []string
+}
+
+func newStatsdEmitter(addr string) *statsdEmitter {
+	conn, err := net.Dial("udp", addr)
+	checkFatal(err, "error in connecting to statsd: %v", addr)
+
+	s := &statsdEmitter{conn: conn}
+	typ := reflect.TypeOf(progStats{})
+	for i := 0; i < typ.NumField(); i++ {
+		s.names = append(s.names, cStatsdPrefix+snakeCase(typ.Field(i).Name))
+	}
+
+	return s
+}
+
+func (s *statsdEmitter) write(oldStats, newStats progStats) {
+	if s == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	diff := reflect.ValueOf(newStats.since(oldStats))
+	for i := 0; i < diff.NumField(); i++ {
+		fmt.Fprintf(&buf, "%s:%d|c\n", s.names[i], diff.Field(i).Uint())
+	}
+	fmt.Fprintf(&buf, "%stweet_queue:%d|g\n", cStatsdPrefix, len(tweetChannel))
+	fmt.Fprintf(&buf, "%supsert_queue:%d|g", cStatsdPrefix, len(upsertChannel))
+
+	// a lost packet only loses the metrics of an interval, they are not worth retrying
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		debugf("Unable to send stats to statsd: %v\n", err)
+	}
+}
+
+// snakeCase turns the name of a stat, such as ErrorsJSON, into a metric name like
+// errors_json.
+func snakeCase(name string) string {
+	var buf bytes.Buffer
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			buf.WriteByte('_')
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+	return buf.String()
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+// cRecentTweets is the number of most recent tweet ids remembered to drop the tweets
+// delivered by more than one filtered stream.
+const cRecentTweets = 100000
+
+// filteredStream is a filtered stream of the twitter app whose credentials are in a file.
+type filteredStream struct {
+	CredentialsFile string
+	Track           []string
+}
+
+// filteredStreams is set with repeated -filtered_stream flags.
+type filteredStreams []filteredStream
+
+func (f *filteredStreams) String() string {
+	streams := make([]string, 0, len(*f))
+	for _, s := range *f {
+		streams = append(streams, s.CredentialsFile+"="+strings.Join(s.Track, ","))
+	}
+	return strings.Join(streams, " ")
+}
+
+func (f *filteredStreams) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+		return fmt.Errorf("expected credentials=term[,term...], got %q", value)
+	}
+
+	var track []string
+	for _, term := range strings.Split(parts[1], ",") {
+		if term = strings.TrimSpace(term); term != "" {
+			track = append(track, term)
+		}
+	}
+
+	*f = append(*f, filteredStream{CredentialsFile: parts[0], Track: track})
+	return nil
+}
+
+// recentTweets remembers the ids of the most recent tweets, forgetting the oldest ones.
+type recentTweets struct {
+	sync.Mutex
+	seen  map[string]bool
+	order []string
+	next  int
+}
+
+func newRecentTweets(size int) *recentTweets {
+	return &recentTweets{seen: make(map[string]bool, size), order: make([]string, 0, size)}
+}
+
+// add remembers the id, and reports whether it was new.
+func (r *recentTweets) add(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.seen[id] {
+		return false
+	}
+
+	if len(r.order) < cap(r.order) {
+		r.order = append(r.order, id)
+	} else {
+		delete(r.seen, r.order[r.next])
+		r.order[r.next] = id
+		r.next = (r.next + 1) % len(r.order)
+	}
+	r.seen[id] = true
+	return true
+}
+
+// setupChannelFromFilteredStreams runs every filtered stream with its own credentials,
+// and merges their tweets into a single channel, dropping the tweets delivered by more
+// than one stream. The returned function stops all the streams.
+func setupChannelFromFilteredStreams(streams []filteredStream) (chan interface{}, func()) {
+	dataChan := newTweetChannel()
+	recent := newRecentTweets(cRecentTweets)
+
+	var running []*anaconda.Stream
+	var wg sync.WaitGroup
+	for _, fs := range streams {
+		client := newTwitterClient(readCredentials(fs.CredentialsFile))
+		stream := client.PublicStreamFilter(url.Values{"track": {strings.Join(fs.Track, ",")}})
+		running = append(running, stream)
+		infof("streaming tweets tracking %v with %v\n", fs.Track, fs.CredentialsFile)
+
+		wg.Add(1)
+		go func(stream *anaconda.Stream) {
+			defer wg.Done()
+
+			for t := range stream.C {
+				if tweet, ok := t.(anaconda.Tweet); ok && !recent.add(tweet.IdStr) {
+					continue
+				}
+				dataChan <- t
+			}
+		}(stream)
+	}
+	// the readers drain the merged channel and exit once all the streams have ended
+	go func() {
+		wg.Wait()
+		close(dataChan)
+	}()
+
+	return dataChan, func() {
+		for _, stream := range running {
+			stream.Stop()
+		}
+	}
+}
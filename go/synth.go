@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cSynthTick is the interval at which synthetic tweets are generated, in bursts that
+// keep up with -synth_rate.
+const cSynthTick = 10 * time.Millisecond
+
+var synthHashtags = []string{
+	"golang", "dgraph", "graphql", "databases", "opensource", "cloud", "kubernetes",
+	"devops", "ai", "machinelearning", "datascience", "startup", "tech", "coding",
+	"programming", "linux", "security", "music", "football", "travel", "food",
+	"photography", "news", "weather", "gaming", "movies", "books", "art", "fitness",
+}
+
+var synthWords = []string{
+	"the", "a", "graph", "is", "fast", "today", "new", "release", "just", "shipped",
+	"love", "this", "query", "cluster", "scales", "again", "check", "out", "our",
+	"thread", "benchmark", "results", "are", "in", "why", "does", "nobody", "talk",
+	"about", "latency", "great", "at", "meetup", "tonight",
+}
+
+// synthesizer generates random tweets by a fixed population of users. Users and
+// hashtags are picked with a zipf distribution, a few of them are very popular.
+type synthesizer struct {
+	r        *rand.Rand
+	users    *rand.Zipf
+	hashtags *rand.Zipf
+	nextID   int64
+}
+
+func newSynthesizer(numUsers int) *synthesizer {
+	r := rand.New(rand.NewSource(opts.Seed))
+	return &synthesizer{
+		r:        r,
+		users:    rand.NewZipf(r, 1.1, 1, uint64(numUsers-1)),
+		hashtags: rand.NewZipf(r, 1.1, 1, uint64(len(synthHashtags)-1)),
+		// start from the current time so that the ids of runs don't collide
+		nextID: time.Now().UnixNano(),
+	}
+}
+
+func (s *synthesizer) user(full bool) twitterUser {
+	id := s.users.Uint64() + 1
+	u := twitterUser{
+		UserID:     strconv.FormatUint(id, 10),
+		DgraphType: opts.Mapping.UserType,
+		UserName:   fmt.Sprintf("Synthetic User %d", id),
+		ScreenName: fmt.Sprintf("synth_user_%d", id),
+	}
+	if full {
+		// popular users, with low ids, have more followers
+		u.FollowersCount = intValue(int(1000000/id) + s.r.Intn(100))
+		u.FriendsCount = intValue(s.r.Intn(2000))
+		u.Verified = boolValue(id < 100)
+		u.Description = fmt.Sprintf("Synthetic account number %d", id)
+	}
+
+	return u
+}
+
+func (s *synthesizer) tweet() *twitterTweet {
+	s.nextID++
+
+	words := make([]string, 3+s.r.Intn(15))
+	for i := range words {
+		words[i] = synthWords[s.r.Intn(len(synthWords))]
+	}
+
+	var hashtags []string
+	for i := s.r.Intn(4); i > 0; i-- {
+		hashtags = append(hashtags, synthHashtags[s.hashtags.Uint64()])
+	}
+
+	author := s.user(true)
+	var mentions []twitterUser
+	mentioned := map[string]bool{author.UserID: true}
+	for i := s.r.Intn(4); i > 0; i-- {
+		if m := s.user(false); !mentioned[m.UserID] {
+			mentioned[m.UserID] = true
+			mentions = append(mentions, m)
+		}
+	}
+
+	for _, tag := range hashtags {
+		words = append(words, "#"+tag)
+	}
+	for _, m := range mentions {
+		words = append(words, "@"+m.ScreenName)
+	}
+
+	return &twitterTweet{
+		IDStr:      strconv.FormatInt(s.nextID, 10),
+		DgraphType: opts.Mapping.TweetType,
+		CreatedAt:  time.Now().Format(cDgraphTimeFormat),
+		Message:    strings.Join(words, " "),
+		HashTags:   hashtags,
+		Author:     author,
+		Mention:    mentions,
+		Retweet:    s.r.Intn(10) == 0,
+	}
+}
+
+// setupChannelFromSynth generates synthetic tweets at the given rate per second.
+func setupChannelFromSynth(rate float64, numUsers int) chan interface{} {
+	dataChan := newTweetChannel()
+	go func() {
+		infof("generating %v synthetic tweets/sec by %v users\n", rate, numUsers)
+
+		s := newSynthesizer(numUsers)
+		start := time.Now()
+		ticker := time.NewTicker(cSynthTick)
+		defer ticker.Stop()
+
+		var sent int64
+		for range ticker.C {
+			due := int64(time.Since(start).Seconds() * rate)
+			for ; sent < due; sent++ {
+				dataChan <- s.tweet()
+			}
+		}
+	}()
+
+	return dataChan
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// cTopKCapacityFactor is the number of counters kept per reported entry. Extra counters
+// keep the heavy hitters from being evicted by the long tail of a diverse stream.
+const cTopKCapacityFactor = 10
+
+var mentions *topKCounter
+
+type topKEntry struct {
+	item  string
+	count uint64
+	index int
+}
+
+// topKHeap is a min heap of the counters, the root is the entry to evict.
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*topKEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// topKCounter approximates the most frequent items with the space saving algorithm.
+// It keeps a bounded number of counters, an unseen item replaces the least frequent
+// one and inherits its count, so the counts of the reported items are upper bounds.
+type topKCounter struct {
+	sync.Mutex
+	k       int
+	entries map[string]*topKEntry
+	heap    topKHeap
+}
+
+func newTopKCounter(k int) *topKCounter {
+	return &topKCounter{
+		k:       k,
+		entries: make(map[string]*topKEntry, k*cTopKCapacityFactor),
+	}
+}
+
+func (t *topKCounter) add(item string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if e, ok := t.entries[item]; ok {
+		e.count++
+		heap.Fix(&t.heap, e.index)
+		return
+	}
+
+	if len(t.heap) < t.k*cTopKCapacityFactor {
+		e := &topKEntry{item: item, count: 1}
+		t.entries[item] = e
+		heap.Push(&t.heap, e)
+		return
+	}
+
+	e := t.heap[0]
+	delete(t.entries, e.item)
+	e.item = item
+	e.count++
+	t.entries[item] = e
+	heap.Fix(&t.heap, 0)
+}
+
+func (t *topKCounter) addMentions(tweet *twitterTweet) {
+	for _, user := range tweet.Mention {
+		if user.ScreenName != "" {
+			t.add(user.ScreenName)
+		}
+	}
+}
+
+// top returns the k most frequent items, most frequent first.
+func (t *topKCounter) top() []topKEntry {
+	t.Lock()
+	result := make([]topKEntry, 0, len(t.heap))
+	for _, e := range t.heap {
+		result = append(result, *e)
+	}
+	t.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].count != result[j].count {
+			return result[i].count > result[j].count
+		}
+		return result[i].item < result[j].item
+	})
+	if len(result) > t.k {
+		result = result[:t.k]
+	}
+
+	return result
+}
+
+func (t *topKCounter) String() string {
+	var sb strings.Builder
+	for i, e := range t.top() {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "@%s: %d", e.item, e.count)
+	}
+	return sb.String()
+}